@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// withBasicAuth requires the given credentials for everything but health checks, which are
+// usually made by something that doesn't know them.
+func withBasicAuth(h http.Handler, username string, password string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			h.ServeHTTP(rw, r)
+			return
+		}
+		givenUsername, givenPassword, ok := r.BasicAuth()
+		validUsername := subtle.ConstantTimeCompare([]byte(givenUsername), []byte(username)) == 1
+		validPassword := subtle.ConstantTimeCompare([]byte(givenPassword), []byte(password)) == 1
+		if !ok || !validUsername || !validPassword {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="ica-caldav", charset="UTF-8"`)
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
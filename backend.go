@@ -2,42 +2,82 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"ica-caldav/ica"
 	"log/slog"
+	"net/http"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
 	"github.com/emersion/go-webdav/caldav"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
 )
 
-func NewIcaBackend(ica *ica.ICA) *ICABackend {
+// BackendOptions configures how shopping lists are presented as calendars.
+type BackendOptions struct {
+	// Whether item names are title-cased, ICA keeps them as they were typed
+	TitleCase       bool
+	MaxResourceSize int64
+	ProductID       string
+	// Lists to show, by name or ID. All lists are shown if empty
+	IncludeLists []string
+	// Lists to hide, by name or ID
+	ExcludeLists []string
+	// How long lists fetched from ICA are re-used between requests, 0 only re-uses them within a request
+	ListCacheTTL time.Duration
+	// What times from clients without a timezone are in. Times we return are always in UTC, so that
+	// we never need to include a VTIMEZONE
+	Timezone *time.Location
+}
+
+var defaultBackendOptions = BackendOptions{
+	TitleCase:       true,
+	MaxResourceSize: 1000,
+	ProductID:       "-//cheif//ica-caldav//EN",
+	Timezone:        mustLoadLocation(defaultTimezone),
+}
+
+// NewIcaBackend serves `ica` under `prefix`, which all paths given to and returned by the backend start with.
+// `history` may be nil, in which case items are assumed to be completed when they were last updated.
+func NewIcaBackend(ica *ica.ICA, options BackendOptions, prefix string, history *ItemHistory) *ICABackend {
 	return &ICABackend{
-		ica: ica,
+		ica:     ica,
+		options: options,
+		prefix:  prefix,
+		history: history,
 	}
 }
 
 type ICABackend struct {
-	ica *ica.ICA
+	ica     *ica.ICA
+	options BackendOptions
+	prefix  string
+	history *ItemHistory
 }
 
 func (be *ICABackend) CurrentUserPrincipal(ctx context.Context) (string, error) {
-	return "/user/", nil
+	return be.prefix + principalPath, nil
 }
 
 func (be *ICABackend) CalendarHomeSetPath(ctx context.Context) (string, error) {
-	return "/user/shoppinglists/", nil
+	return be.prefix + calendarHomeSetPath, nil
 }
 
 func (be *ICABackend) ListCalendars(ctx context.Context) ([]caldav.Calendar, error) {
-	lists, err := be.ica.GetShoppingLists()
+	lists, err := be.getLists(ctx)
 	if err != nil {
 		return nil, err
 	}
 	var calendars = make([]caldav.Calendar, 0)
 	for _, list := range lists {
-		calendars = append(calendars, createCalendar(list))
+		calendars = append(calendars, be.createCalendar(list))
 	}
 	return calendars, nil
 }
@@ -47,7 +87,7 @@ func (be *ICABackend) GetCalendar(ctx context.Context, path string) (*caldav.Cal
 	if err != nil {
 		return nil, err
 	}
-	cal := createCalendar(*list)
+	cal := be.createCalendar(*list)
 	return &cal, nil
 }
 
@@ -59,7 +99,7 @@ func (be *ICABackend) ListCalendarObjects(ctx context.Context, path string, req
 	calendarObjects := make([]caldav.CalendarObject, 0)
 	for _, row := range list.Rows {
 		calendarObjects = append(calendarObjects,
-			createCalendarObject(
+			be.createCalendarObject(
 				row,
 				fmt.Sprintf("%s%s", path, row.Id),
 			),
@@ -83,7 +123,7 @@ func (be *ICABackend) GetCalendarObject(ctx context.Context, path string, req *c
 	}
 	for _, row := range list.Rows {
 		if row.Id == id {
-			cal := createCalendarObject(row, path)
+			cal := be.createCalendarObject(row, path)
 			return &cal, nil
 		}
 	}
@@ -94,16 +134,20 @@ func (be *ICABackend) GetCalendarObject(ctx context.Context, path string, req *c
 }
 
 func (be *ICABackend) PutCalendarObject(ctx context.Context, path string, calendar *ical.Calendar, opts *caldav.PutCalendarObjectOptions) (obj *caldav.CalendarObject, err error) {
-	todo, err := getTodo(calendar)
-	if err != nil {
-		return nil, err
+	todo, invalid := getTodo(calendar)
+	if invalid != nil {
+		return nil, preconditionError(ctx, invalid.precondition, invalid.reason)
 	}
-
-	name, err := todo.Props.Text(ical.PropSummary)
-	if err != nil {
-		return nil, err
+	name, _ := todo.Props.Text(ical.PropSummary)
+	id, _ := todo.Props.Text(ical.PropUID)
+	// ICA doesn't keep DTSTART or DUE, but clients should hear about times we can't read
+	for _, prop := range []string{ical.PropDateTimeStart, ical.PropDue} {
+		if _, err := dateTime(calendar, todo, prop, be.options.Timezone); err != nil {
+			return nil, preconditionError(ctx, caldav.PreconditionValidCalendarData, fmt.Sprintf("Invalid %v: %v", prop, err))
+		}
 	}
-	id, err := todo.Props.Text(ical.PropUID)
+
+	err = be.CheckPreconditions(ctx, path, opts.IfMatch, opts.IfNoneMatch)
 	if err != nil {
 		return nil, err
 	}
@@ -114,15 +158,21 @@ func (be *ICABackend) PutCalendarObject(ctx context.Context, path string, calend
 		return nil, err
 	}
 	for _, row := range list.Rows {
+		if row.Id == id && path != fmt.Sprintf("%v%v", listPath, row.Id) {
+			return nil, preconditionError(ctx, caldav.PreconditionNoUIDConflict, fmt.Sprintf("%v is already used by %v%v", id, listPath, row.Id))
+		}
 		if row.Id == id {
 			// This just means something (Apple reminder) tries to update the items (for some reason).
 			// We just ignore these cases
-			cal := createCalendarObject(row, path)
+			cal := be.createCalendarObject(row, path)
 			return &cal, nil
 		}
 	}
 
-	completed, _ := todo.Props.DateTime(ical.PropCompleted, time.Local)
+	completed, err := dateTime(calendar, todo, ical.PropCompleted, be.options.Timezone)
+	if err != nil {
+		return nil, preconditionError(ctx, caldav.PreconditionValidCalendarData, fmt.Sprintf("Invalid %v: %v", ical.PropCompleted, err))
+	}
 	if !completed.IsZero() {
 		// We don't want to add already completed items
 		return nil, fmt.Errorf("Adding completed items isn't supported")
@@ -135,40 +185,179 @@ func (be *ICABackend) PutCalendarObject(ctx context.Context, path string, calend
 	if err != nil {
 		return nil, err
 	}
+	be.history.Added(*row, time.Now())
+	be.listCache(ctx).Invalidate()
 	newPath := fmt.Sprintf("%v/%v", listPath, row.Id)
-	cal := createCalendarObject(*row, newPath)
+	cal := be.createCalendarObject(*row, newPath)
 	return &cal, nil
 }
 
+var errPreconditionFailed = errors.New("Precondition failed")
+
+// CheckPreconditions returns a 412 error unless the item at `path` matches `If-Match` and `If-None-Match`,
+// so that clients editing the same item at the same time don't overwrite each other's changes.
+func (be *ICABackend) CheckPreconditions(ctx context.Context, path string, ifMatch webdav.ConditionalMatch, ifNoneMatch webdav.ConditionalMatch) error {
+	if !ifMatch.IsSet() && !ifNoneMatch.IsSet() {
+		return nil
+	}
+	var etag string
+	listPath, id := filepath.Split(path)
+	if list, err := be.getList(ctx, listPath); err == nil {
+		for _, row := range list.Rows {
+			if row.Id == id {
+				etag = row.ETag()
+			}
+		}
+	} else if !errors.Is(err, errListNotFound) {
+		return err
+	}
+
+	if ifMatch.IsSet() && !matchesETag(ifMatch, etag) {
+		return webdav.NewHTTPError(http.StatusPreconditionFailed, fmt.Errorf("%w: If-Match doesn't match %v", errPreconditionFailed, path))
+	}
+	if ifNoneMatch.IsSet() && matchesETag(ifNoneMatch, etag) {
+		return webdav.NewHTTPError(http.StatusPreconditionFailed, fmt.Errorf("%w: If-None-Match matches %v", errPreconditionFailed, path))
+	}
+	return nil
+}
+
+// matchesETag compares a conditional header with the ETag of a resource, or "" if it doesn't exist.
+// ETags are compared strongly, since a weak match isn't good enough for overwriting an item.
+func matchesETag(condition webdav.ConditionalMatch, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	if condition.IsWildcard() {
+		return true
+	}
+	for _, part := range strings.Split(string(condition), ",") {
+		if given, err := webdav.ConditionalMatch(strings.TrimSpace(part)).ETag(); err == nil && given == etag {
+			return true
+		}
+	}
+	return false
+}
+
 // Cache
 type ListCache struct {
 	ica   *ica.ICA
 	Lists []ica.ShoppingList
+	// Told about every lookup, and whether it was served from the cache
+	observe func(hit bool)
+	// Lists from earlier requests, if they should be re-used
+	shared *SharedListCache
+	// Told about every list fetched from ICA, may be nil
+	history *ItemHistory
 }
 
 func (c *ListCache) GetShoppingLists() ([]ica.ShoppingList, error) {
-	if len(c.Lists) > 0 {
+	if len(c.Lists) == 0 && c.shared != nil {
+		c.Lists = c.shared.get(time.Now())
+	}
+	hit := len(c.Lists) > 0
+	if c.observe != nil {
+		c.observe(hit)
+	}
+	if hit {
 		return c.Lists, nil
 	}
 	lists, err := c.ica.GetShoppingLists()
 	c.Lists = lists
+	if err == nil {
+		c.history.Observe(lists, time.Now())
+	}
+	if err == nil && c.shared != nil {
+		c.shared.set(lists, time.Now())
+	}
 	return lists, err
 }
 
-// Utilities
-func (be *ICABackend) getList(ctx context.Context, path string) (*ica.ShoppingList, error) {
+// Invalidate makes sure that the lists are fetched again, e.g. after we've changed them.
+func (c *ListCache) Invalidate() {
+	c.Lists = nil
+	c.shared.clear()
+}
 
+// SharedListCache keeps lists between requests, for up to `ttl`.
+type SharedListCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	lists   []ica.ShoppingList
+	fetched time.Time
+}
+
+func NewSharedListCache(ttl time.Duration) *SharedListCache {
+	return &SharedListCache{ttl: ttl}
+}
+
+func (c *SharedListCache) get(now time.Time) []ica.ShoppingList {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.fetched) > c.ttl {
+		return nil
+	}
+	return c.lists
+}
+
+func (c *SharedListCache) set(lists []ica.ShoppingList, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lists = lists
+	c.fetched = now
+}
+
+func (c *SharedListCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lists = nil
+}
+
+// Utilities
+func (be *ICABackend) listCache(ctx context.Context) *ListCache {
 	// Try using pre-fetched lists from context first
-	listCache, ok := ctx.Value("listCache").(ListCache)
+	listCache, ok := ctx.Value("listCache").(*ListCache)
 	if !ok {
 		panic("")
 	}
-	lists, err := listCache.GetShoppingLists()
+	return listCache
+}
+
+// getLists returns the lists that should be shown, according to the options.
+func (be *ICABackend) getLists(ctx context.Context) ([]ica.ShoppingList, error) {
+	lists, err := be.listCache(ctx).GetShoppingLists()
+	if err != nil {
+		return nil, err
+	}
+	shown := make([]ica.ShoppingList, 0, len(lists))
+	for _, list := range lists {
+		matches := func(names []string) bool {
+			return slices.ContainsFunc(names, func(name string) bool {
+				return name == list.Id || strings.EqualFold(name, list.Name)
+			})
+		}
+		if len(be.options.IncludeLists) > 0 && !matches(be.options.IncludeLists) {
+			continue
+		}
+		if matches(be.options.ExcludeLists) {
+			continue
+		}
+		shown = append(shown, list)
+	}
+	return shown, nil
+}
+
+var errListNotFound = errors.New("Not Found")
+
+func (be *ICABackend) getList(ctx context.Context, path string) (*ica.ShoppingList, error) {
+	lists, err := be.getLists(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	id, err := filepath.Rel("/user/shoppinglists/", path)
+	id, err := filepath.Rel(be.prefix+calendarHomeSetPath, path)
 	if err != nil {
 		return nil, err
 	}
@@ -177,54 +366,92 @@ func (be *ICABackend) getList(ctx context.Context, path string) (*ica.ShoppingLi
 			return &list, nil
 		}
 	}
-	return nil, fmt.Errorf("Not Found")
+	return nil, errListNotFound
 }
 
-func createCalendar(list ica.ShoppingList) caldav.Calendar {
+func (be *ICABackend) createCalendar(list ica.ShoppingList) caldav.Calendar {
 	return caldav.Calendar{
-		Path:                  fmt.Sprintf("/user/shoppinglists/%s/", list.Id),
+		Path:                  fmt.Sprintf("%v%v%v/", be.prefix, calendarHomeSetPath, list.Id),
 		Name:                  list.Name,
-		MaxResourceSize:       1000,
+		MaxResourceSize:       be.options.MaxResourceSize,
 		SupportedComponentSet: []string{"VTODO"},
 	}
 }
 
-func createCalendarObject(row ica.ShoppingListRow, path string) caldav.CalendarObject {
+func (be *ICABackend) createCalendarObject(row ica.ShoppingListRow, path string) caldav.CalendarObject {
+	etag := row.ETag()
+	if be.options.TitleCase {
+		row.Name = cases.Title(language.Swedish).String(row.Name)
+	}
 	cal := ical.NewCalendar()
 	cal.Props.SetText(ical.PropVersion, "2.0")
-	cal.Props.SetText(ical.PropProductID, "-//xyz Corp//NONSGML PDA Calendar Version 1.0//EN")
+	cal.Props.SetText(ical.PropProductID, be.options.ProductID)
 	cal.Children = []*ical.Component{
-		createEvent(row).Component,
+		createTodo(row, be.history.Created(row), be.history.Completed(row)),
 	}
 	return caldav.CalendarObject{
 		Path:    path,
 		Data:    cal,
 		ModTime: row.Updated,
-		ETag:    row.ETag(),
+		ETag:    etag,
 	}
 }
 
-func createEvent(row ica.ShoppingListRow) ical.Event {
-	event := ical.NewEvent()
-	event.Name = ical.CompToDo
-	event.Props.SetText(ical.PropUID, row.Id)
-	event.Props.SetDateTime(ical.PropDateTimeStamp, row.Updated)
-	event.Props.SetText(ical.PropSummary, row.Name)
-	event.Props.SetText(ical.PropDescription, "")
+func createTodo(row ica.ShoppingListRow, created time.Time, completed time.Time) *ical.Component {
+	todo := ical.NewComponent(ical.CompToDo)
+	todo.Props.SetText(ical.PropUID, row.Id)
+	// ICA returns times with an offset but no timezone, which can only be written in UTC
+	todo.Props.SetDateTime(ical.PropDateTimeStamp, row.Updated.UTC())
+	todo.Props.SetDateTime(ical.PropLastModified, row.Updated.UTC())
+	if !created.IsZero() {
+		todo.Props.SetDateTime(ical.PropCreated, created.UTC())
+	}
+	todo.Props.SetText(ical.PropSummary, row.Name)
 	if row.IsStriked {
-		// We just assume that it was striked out when last updated
-		event.Props.SetDateTime(ical.PropCompleted, row.Updated)
+		todo.Props.SetText(ical.PropStatus, "COMPLETED")
+		todo.Props.SetText(ical.PropPercentComplete, "100")
+		todo.Props.SetDateTime(ical.PropCompleted, completed.UTC())
+	} else {
+		todo.Props.SetText(ical.PropStatus, "NEEDS-ACTION")
+		todo.Props.SetText(ical.PropPercentComplete, "0")
 	}
-	return *event
+	return todo
 }
 
-func getTodo(calendar *ical.Calendar) (*ical.Component, error) {
+type invalidTodo struct {
+	precondition caldav.PreconditionType
+	reason       string
+}
+
+// getTodo returns the item in `calendar`, which must be a single VTODO with a UID and SUMMARY.
+func getTodo(calendar *ical.Calendar) (*ical.Component, *invalidTodo) {
+	var todos []*ical.Component
 	for _, child := range calendar.Children {
-		if child.Name == ical.CompToDo {
-			return child, nil
+		switch child.Name {
+		case ical.CompToDo:
+			todos = append(todos, child)
+		case ical.CompTimezone:
+		default:
+			return nil, &invalidTodo{caldav.PreconditionSupportedCalendarComponent, fmt.Sprintf("%v isn't supported", child.Name)}
 		}
 	}
-	return nil, fmt.Errorf("Unsupported number of children")
+	if len(todos) == 0 {
+		return nil, &invalidTodo{caldav.PreconditionValidCalendarObjectResource, "No VTODO"}
+	}
+	uid, _ := todos[0].Props.Text(ical.PropUID)
+	for _, todo := range todos[1:] {
+		// Recurring items are several VTODOs with the same UID, but we only care about the first
+		if other, _ := todo.Props.Text(ical.PropUID); other != uid {
+			return nil, &invalidTodo{caldav.PreconditionValidCalendarObjectResource, "More than one UID"}
+		}
+	}
+	if strings.TrimSpace(uid) == "" {
+		return nil, &invalidTodo{caldav.PreconditionValidCalendarData, "No UID"}
+	}
+	if name, _ := todos[0].Props.Text(ical.PropSummary); strings.TrimSpace(name) == "" {
+		return nil, &invalidTodo{caldav.PreconditionValidCalendarData, "No SUMMARY"}
+	}
+	return todos[0], nil
 }
 
 // Not implemented, but required by interface
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"ica-caldav/ica"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-ical"
+)
+
+const listsURL = "https://apimgw-pub.ica.se/sverige/digx/shopping-list/v1/api/list/all"
+
+func TestETagIgnoresTitleCase(t *testing.T) {
+	row := ica.ShoppingListRow{Id: "row", Name: "mjölk", Updated: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	titleCased := NewIcaBackend(nil, defaultBackendOptions, "", nil).createCalendarObject(row, "/user/shoppinglists/list/row")
+	options := defaultBackendOptions
+	options.TitleCase = false
+	asTyped := NewIcaBackend(nil, options, "", nil).createCalendarObject(row, "/user/shoppinglists/list/row")
+	if titleCased.ETag != asTyped.ETag || titleCased.ETag != row.ETag() {
+		t.Errorf("ETag depends on title-casing: %v %v", titleCased.ETag, asTyped.ETag)
+	}
+
+	row.IsStriked = true
+	if row.ETag() == titleCased.ETag {
+		t.Error("ETag didn't change with the row")
+	}
+}
+
+func TestPreconditions(t *testing.T) {
+	row := ica.ShoppingListRow{Id: "row", Name: "mjölk", Updated: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	etag := fmt.Sprintf(`"%v"`, row.ETag())
+	todo := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:test\r\nBEGIN:VTODO\r\nUID:%v\r\nDTSTAMP:20250101T120000Z\r\nSUMMARY:Bröd\r\nEND:VTODO\r\nEND:VCALENDAR\r\n"
+
+	fake := &fakeICA{}
+	handler := newCalDAVHandler(replayProvider{fake}, defaultBackendOptions, nil, nil, nil)
+	for _, test := range []struct {
+		method             string
+		path               string
+		header             string
+		value              string
+		preconditionFailed bool
+	}{
+		{"PUT", "/user/shoppinglists/list/row", "If-None-Match", "*", true},
+		{"PUT", "/user/shoppinglists/list/row", "If-Match", `"outdated"`, true},
+		{"PUT", "/user/shoppinglists/list/row", "If-Match", etag, false},
+		{"PUT", "/user/shoppinglists/list/new", "If-Match", "*", true},
+		{"PUT", "/user/shoppinglists/list/new", "If-None-Match", "*", false},
+		{"DELETE", "/user/shoppinglists/list/row", "If-Match", `"outdated"`, true},
+		{"DELETE", "/user/shoppinglists/list/row", "If-None-Match", etag, true},
+	} {
+		fake.expect([]recordedCall{{Method: "GET", URL: listsURL, Status: http.StatusOK, Body: recordedLists}})
+		id := test.path[strings.LastIndex(test.path, "/")+1:]
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(fmt.Sprintf(todo, id)))
+		req.Header.Set("Content-Type", "text/calendar")
+		req.Header.Set(test.header, test.value)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		if (rw.Code == http.StatusPreconditionFailed) != test.preconditionFailed {
+			t.Errorf("%v %v with %v: %v: %v", test.method, test.path, test.header, test.value, rw.Code)
+		}
+	}
+}
+
+func TestTodo(t *testing.T) {
+	updated := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	history, err := LoadItemHistory(CacheFS{path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := NewIcaBackend(nil, defaultBackendOptions, "", history)
+	row := ica.ShoppingListRow{Id: "row", Name: "mjölk", Updated: updated}
+	history.Added(row, updated.Add(-time.Hour))
+
+	todo := be.createCalendarObject(row, "/user/shoppinglists/list/row").Data.Children[0]
+	for name, expected := range map[string]string{
+		ical.PropStatus:          "NEEDS-ACTION",
+		ical.PropPercentComplete: "0",
+		ical.PropLastModified:    "20250101T120000Z",
+		ical.PropCreated:         "20250101T110000Z",
+	} {
+		if value := todo.Props.Get(name); value == nil || value.Value != expected {
+			t.Errorf("Incorrect %v: %v", name, value)
+		}
+	}
+	if todo.Props.Get(ical.PropDescription) != nil || todo.Props.Get(ical.PropCompleted) != nil {
+		t.Errorf("Unexpected properties: %v", todo.Props)
+	}
+
+	// Changing the item afterwards doesn't move when it was completed
+	row.IsStriked = true
+	history.Observe([]ica.ShoppingList{{Id: "list", Rows: []ica.ShoppingListRow{row}}}, time.Now())
+	row.Name = "Mjölk"
+	row.Updated = updated.Add(time.Hour)
+	if err := history.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	history, err = LoadItemHistory(history.cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	todo = NewIcaBackend(nil, defaultBackendOptions, "", history).createCalendarObject(row, "/user/shoppinglists/list/row").Data.Children[0]
+	if completed := todo.Props.Get(ical.PropCompleted); completed == nil || completed.Value != "20250101T120000Z" {
+		t.Errorf("Incorrect completion: %v", completed)
+	}
+	if status := todo.Props.Get(ical.PropStatus); status == nil || status.Value != "COMPLETED" {
+		t.Errorf("Incorrect status: %v", status)
+	}
+
+	row.IsStriked = false
+	if completed := history.Completed(row); !completed.IsZero() {
+		t.Errorf("Still completed: %v", completed)
+	}
+}
+
+func TestCompletedIsReadOnly(t *testing.T) {
+	history, err := LoadItemHistory(CacheFS{path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := ica.ShoppingListRow{Id: "row", Name: "mjölk", IsStriked: true, Updated: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	// Until the row is observed striked, the guess follows the row
+	if completed := history.Completed(row); !completed.Equal(row.Updated) || len(history.items) != 0 || history.dirty {
+		t.Errorf("Incorrect completion: %v %v", completed, history.items)
+	}
+	history.Observe([]ica.ShoppingList{{Id: "list", Rows: []ica.ShoppingListRow{row}}}, time.Now())
+	row.Updated = row.Updated.Add(time.Hour)
+	if completed := history.Completed(row); !completed.Equal(row.Updated.Add(-time.Hour)) {
+		t.Errorf("Completion moved: %v", completed)
+	}
+}
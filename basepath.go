@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Headers a reverse proxy uses to tell us how clients reached it
+var forwardedHeaders = []string{"X-Forwarded-Prefix", "X-Forwarded-Proto"}
+
+// withBasePath serves everything under `basePath`, and nothing outside it. With `trustProxy`, links
+// use the prefix that a reverse proxy says it has stripped with `X-Forwarded-Prefix`, and the scheme
+// from `X-Forwarded-Proto`. Otherwise anyone could send those, and make us redirect elsewhere.
+// Handlers see paths without the prefix, and use basePathFrom when generating links.
+func withBasePath(h http.Handler, basePath string, trustProxy bool) http.Handler {
+	basePath = strings.TrimSuffix(basePath, "/")
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		prefix := basePath
+		if forwarded := r.Header.Get("X-Forwarded-Prefix"); trustProxy && forwarded != "" && validBasePath(forwarded) {
+			prefix = strings.TrimSuffix(forwarded, "/")
+		}
+		if basePath != "" && r.URL.Path == basePath && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			// Relative links on the setup page only work with the trailing slash
+			http.Redirect(rw, r, basePath+"/", http.StatusMovedPermanently)
+			return
+		}
+
+		r = r.Clone(context.WithValue(r.Context(), "basePath", prefix))
+		if !trustProxy {
+			for _, name := range forwardedHeaders {
+				r.Header.Del(name)
+			}
+		}
+		if basePath != "" {
+			path, ok := strings.CutPrefix(r.URL.Path, basePath)
+			if !ok || (path != "" && !strings.HasPrefix(path, "/")) {
+				http.NotFound(rw, r)
+				return
+			}
+			r.URL.Path = "/" + strings.TrimPrefix(path, "/")
+			r.URL.RawPath = ""
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// validBasePath tells whether `path` can be put in front of our paths, without links ending up on another host.
+func validBasePath(path string) bool {
+	return strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//") && !strings.ContainsAny(path, "?#\\")
+}
+
+func basePathFrom(ctx context.Context) string {
+	basePath, _ := ctx.Value("basePath").(string)
+	return basePath
+}
+
+// externalURL is where the client reached us, as seen from the other side of any reverse proxy.
+// `X-Forwarded-Proto` is only left on requests by withBasePath when the proxy is trusted.
+func externalURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return fmt.Sprintf("%v://%v%v/", scheme, r.Host, basePathFrom(r.Context()))
+}
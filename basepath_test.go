@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBasePath(t *testing.T) {
+	fake := &fakeICA{}
+	fake.expect([]recordedCall{{
+		Method: "GET",
+		URL:    "https://apimgw-pub.ica.se/sverige/digx/shopping-list/v1/api/list/all",
+		Status: http.StatusOK,
+		Body:   recordedLists,
+	}})
+	caldavHandler := newCalDAVHandler(replayProvider{fake}, defaultBackendOptions, nil, nil, nil)
+	handler := withBasePath(mux(http.NotFoundHandler(), http.NotFoundHandler(), caldavHandler), "/ica/", false)
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/ica", nil))
+	if rw.Code != http.StatusMovedPermanently || rw.Header().Get("Location") != "/ica/" {
+		t.Errorf("Incorrect redirect: %v %v", rw.Code, rw.Header())
+	}
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/ica/.well-known/caldav", nil))
+	if rw.Header().Get("Location") != "/ica/user/" {
+		t.Errorf("Incorrect discovery redirect: %v", rw.Header())
+	}
+
+	for _, path := range []string{"/user/", "/icas/user/", "/other/ica/"} {
+		rw = httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("PROPFIND", path, nil))
+		if rw.Code != http.StatusNotFound {
+			t.Errorf("%v outside basePath: %v", path, rw.Code)
+		}
+	}
+
+	req := httptest.NewRequest("PROPFIND", "/ica/user/shoppinglists/list/", strings.NewReader(""))
+	req.Header.Set("Depth", "1")
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	if body := rw.Body.String(); rw.Code != http.StatusMultiStatus || !strings.Contains(body, "<href>/ica/user/shoppinglists/list/row</href>") {
+		t.Errorf("Incorrect response: %v %v", rw.Code, body)
+	}
+}
+
+func TestForwardedPrefix(t *testing.T) {
+	handler := withBasePath(newCalDAVHandler(noSession{}, defaultBackendOptions, nil, nil, nil), "", true)
+	req := httptest.NewRequest("PROPFIND", "/user/", strings.NewReader(principalPropfind))
+	req.Header.Set("Depth", "0")
+	req.Header.Set("X-Forwarded-Prefix", "/proxied/")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	if body := rw.Body.String(); !strings.Contains(body, `<href xmlns="DAV:">/proxied/user/shoppinglists/</href>`) {
+		t.Errorf("Incorrect response: %v", body)
+	}
+
+	req = httptest.NewRequest("GET", "/ica/user/", nil)
+	req.Header.Set("X-Forwarded-Prefix", "/proxied")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Host = "example.com"
+	var url string
+	external := func(rw http.ResponseWriter, r *http.Request) {
+		url = externalURL(r)
+	}
+	withBasePath(http.HandlerFunc(external), "", true).ServeHTTP(httptest.NewRecorder(), req)
+	if url != "https://example.com/proxied/" {
+		t.Errorf("Incorrect external URL: %v", url)
+	}
+
+	// Anyone can send these, unless there's a proxy in front of us that replaces them
+	withBasePath(http.HandlerFunc(external), "/ica", false).ServeHTTP(httptest.NewRecorder(), req.Clone(req.Context()))
+	if url != "http://example.com/ica/" {
+		t.Errorf("Forwarded headers used without trustProxy: %v", url)
+	}
+	req.Header.Set("X-Forwarded-Prefix", "//evil.example")
+	withBasePath(http.HandlerFunc(external), "/ica", true).ServeHTTP(httptest.NewRecorder(), req.Clone(req.Context()))
+	if url != "https://example.com/ica/" {
+		t.Errorf("Invalid prefix used: %v", url)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const cacheKeyEnv = "ICA_CALDAV_CACHE_KEY"
+
+type cacheOptions struct {
+	path    *string
+	keyFile *string
+}
+
+// Adds the flags needed to open the cache, which is shared between the server and all commands.
+func addCacheFlags(flags *flag.FlagSet) cacheOptions {
+	return cacheOptions{
+		path:    flags.String("cachePath", ".cache", "Path where we save session-data etc"),
+		keyFile: flags.String("cacheKeyFile", "", fmt.Sprintf("File with the key used to encrypt the session at rest, can also be given through $%v", cacheKeyEnv)),
+	}
+}
+
+func (o cacheOptions) open() (CacheFS, error) {
+	err := os.MkdirAll(*o.path, 0700)
+	if err != nil {
+		return CacheFS{}, err
+	}
+	key := os.Getenv(cacheKeyEnv)
+	if *o.keyFile != "" {
+		data, err := os.ReadFile(*o.keyFile)
+		if err != nil {
+			return CacheFS{}, err
+		}
+		key = strings.TrimSpace(string(data))
+	}
+	cache := CacheFS{path: *o.path}
+	if key != "" {
+		// Derived once here, instead of for every write
+		cache.sealer, err = newSealer(key)
+		if err != nil {
+			return CacheFS{}, err
+		}
+	}
+	return cache, nil
+}
+
+// CacheFS stores files in a directory, encrypting them if there's a key.
+type CacheFS struct {
+	path string
+	// Encrypts the files, nil if there's no key
+	sealer *sealer
+}
+
+func (fs CacheFS) ReadFile(path string) ([]byte, error) {
+	fullPath := fmt.Sprintf("%v/%v", fs.path, path)
+	data, err := os.ReadFile(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if isSealed(data) {
+		if fs.sealer == nil {
+			return nil, fmt.Errorf("%v is encrypted, but no key was given", path)
+		}
+		return fs.sealer.unseal(data)
+	}
+	if fs.sealer != nil {
+		// Written before we had a key, encrypt it right away
+		slog.Info("Encrypting cache file",
+			"path", path,
+		)
+		err = fs.WriteFile(path, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// Writes to a temporary file first, and then renames it, so that we never leave a half-written file behind.
+func (fs CacheFS) WriteFile(path string, b []byte) error {
+	if fs.sealer != nil {
+		sealed, err := fs.sealer.seal(b)
+		if err != nil {
+			return err
+		}
+		b = sealed
+	}
+	fullPath := fmt.Sprintf("%v/%v", fs.path, path)
+	file, err := os.CreateTemp(fs.path, fmt.Sprintf(".%v.*", filepath.Base(path)))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	// Only we should be able to read the session
+	err = file.Chmod(0600)
+	if err == nil {
+		_, err = file.Write(b)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), fullPath)
+}
+
+func (fs CacheFS) Remove(path string) error {
+	fullPath := fmt.Sprintf("%v/%v", fs.path, path)
+	err := os.Remove(fullPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheFSEncryptsAtRest(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "session.json")
+	if err := os.WriteFile(path, []byte("plaintext"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sealer, err := newSealer("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := CacheFS{path: dir, sealer: sealer}
+	data, err := cache.ReadFile("session.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "plaintext" {
+		t.Errorf("Incorrect data: %s", data)
+	}
+
+	// Reading migrated the file
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(raw) {
+		t.Errorf("File wasn't encrypted: %s", raw)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Incorrect permissions: %v", info.Mode().Perm())
+	}
+
+	data, err = cache.ReadFile("session.json")
+	if err != nil || string(data) != "plaintext" {
+		t.Errorf("Could not read encrypted file: %s, %v", data, err)
+	}
+
+	if _, err := (CacheFS{path: dir}).ReadFile("session.json"); err == nil {
+		t.Error("Read encrypted file without key")
+	}
+
+	// Files written with another salt, e.g. before restarting, can still be read
+	other, err := newSealer("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = CacheFS{path: dir, sealer: other}.ReadFile("session.json")
+	if err != nil || string(data) != "plaintext" {
+		t.Errorf("Could not read file sealed with another salt: %s, %v", data, err)
+	}
+	if len(sealer.aeads) != 1 {
+		t.Errorf("Key derived more than once: %v", len(sealer.aeads))
+	}
+}
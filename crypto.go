@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Prefix of everything we've sealed, so that it's easy to tell it apart from plaintext.
+const sealedPrefix = "ica-caldav:v1:"
+
+const (
+	saltSize         = 16
+	keySize          = 32
+	pbkdf2Iterations = 100_000
+)
+
+// seal encrypts and authenticates `plaintext` with AES-GCM, using a key derived from `passphrase`.
+func seal(passphrase string, plaintext []byte) ([]byte, error) {
+	s, err := newSealer(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(plaintext)
+}
+
+// unseal reverses seal, failing if the data has been tampered with or the passphrase is wrong.
+func unseal(passphrase string, sealed []byte) ([]byte, error) {
+	return (&sealer{passphrase: passphrase}).unseal(sealed)
+}
+
+// sealer seals everything with the same salt, and remembers the keys it has derived, since deriving
+// them is slow on purpose.
+type sealer struct {
+	passphrase string
+	salt       []byte
+
+	mu    sync.Mutex
+	aeads map[string]cipher.AEAD
+}
+
+func newSealer(passphrase string) (*sealer, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("A passphrase is required")
+	}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	s := &sealer{passphrase: passphrase, salt: salt}
+	// So that it's already derived when first needed
+	if _, err := s.aead(salt); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sealer) seal(plaintext []byte) ([]byte, error) {
+	aead, err := s.aead(s.salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	payload := append(bytes.Clone(s.salt), nonce...)
+	payload = aead.Seal(payload, nonce, plaintext, []byte(sealedPrefix))
+	encoded := base64.StdEncoding.EncodeToString(payload)
+	return []byte(sealedPrefix + encoded), nil
+}
+
+func (s *sealer) unseal(sealed []byte) ([]byte, error) {
+	if !isSealed(sealed) {
+		return nil, fmt.Errorf("Data isn't sealed")
+	}
+	payload, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sealed[len(sealedPrefix):])))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < saltSize {
+		return nil, fmt.Errorf("Sealed data is too short")
+	}
+	salt, payload := payload[:saltSize], payload[saltSize:]
+	aead, err := s.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < aead.NonceSize() {
+		return nil, fmt.Errorf("Sealed data is too short")
+	}
+	nonce, ciphertext := payload[:aead.NonceSize()], payload[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(sealedPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt, wrong passphrase?")
+	}
+	return plaintext, nil
+}
+
+// aead returns the cipher for `salt`, deriving its key the first time.
+func (s *sealer) aead(salt []byte) (cipher.AEAD, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if aead, ok := s.aeads[string(salt)]; ok {
+		return aead, nil
+	}
+	aead, err := newAEAD(s.passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if s.aeads == nil {
+		s.aeads = make(map[string]cipher.AEAD)
+	}
+	s.aeads[string(salt)] = aead
+	return aead, nil
+}
+
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(sealedPrefix))
+}
+
+func newAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, pbkdf2Iterations, keySize, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUnsealExisting(t *testing.T) {
+	// Sealed before using x/crypto, which must derive the same key
+	sealed := "ica-caldav:v1:mkmbMYBc0+wgIX633zhE28BaMYqvqCwfcixFYzSzAvHhTlrCSfDQd3JchMBXbFFX994G"
+	plaintext, err := unseal("secret", []byte(sealed))
+	if err != nil || string(plaintext) != "session" {
+		t.Errorf("Could not unseal: %q %v", plaintext, err)
+	}
+}
+
+func TestSealRoundtrip(t *testing.T) {
+	sealed, err := seal("secret", []byte("session"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(sealed) {
+		t.Errorf("Missing prefix: %s", sealed)
+	}
+
+	plaintext, err := unseal("secret", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "session" {
+		t.Errorf("Incorrect plaintext: %s", plaintext)
+	}
+
+	if _, err := unseal("wrong", sealed); err == nil {
+		t.Error("Unsealed with the wrong passphrase")
+	}
+	sealed[len(sealed)-2] ^= 1
+	if _, err := unseal("secret", sealed); err == nil {
+		t.Error("Unsealed tampered data")
+	}
+	if _, err := seal("", []byte("session")); err == nil {
+		t.Error("Sealed without passphrase")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+)
+
+// Remembers that the browser has given the debug token. It holds a MAC derived from the token rather
+// than the token itself, so that the token can't be read back from the browser.
+const debugTokenCookie = "ica-caldav-debug"
+
+// newServerForDebug shows the recent exchanges kept by `recorder`, to anyone that knows `token`.
+// Without a token the page is disabled, since it shows the shopping lists and everything else we send.
+// The token is posted from a form, so that it never ends up in URLs, and through them in logs.
+func newServerForDebug(recorder *Recorder, token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/debug", func(rw http.ResponseWriter, r *http.Request) {
+		executeTemplate(rw, "debug.html", recorder.Recent())
+	})
+
+	mux.HandleFunc("/debug/exchanges", func(rw http.ResponseWriter, r *http.Request) {
+		executeTemplate(rw, "exchanges", recorder.Recent())
+	})
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if recorder == nil || token == "" {
+			http.NotFound(rw, r)
+			return
+		}
+		debugPath := basePathFrom(r.Context()) + "/debug"
+		if r.Method == http.MethodPost && r.URL.Path == "/debug" {
+			if !validDebugToken(token, r.PostFormValue("token")) {
+				serveDebugLogin(rw, true)
+				return
+			}
+			http.SetCookie(rw, &http.Cookie{
+				Name:     debugTokenCookie,
+				Value:    debugSession(token),
+				Path:     debugPath,
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			http.Redirect(rw, r, debugPath, http.StatusSeeOther)
+			return
+		}
+		cookie, err := r.Cookie(debugTokenCookie)
+		if err != nil || !validDebugToken(debugSession(token), cookie.Value) {
+			serveDebugLogin(rw, false)
+			return
+		}
+		mux.ServeHTTP(rw, r)
+	})
+}
+
+// serveDebugLogin asks for the token, `failed` tells that a wrong one was given.
+func serveDebugLogin(rw http.ResponseWriter, failed bool) {
+	// Set before the status, since executeTemplate can't do that anymore
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(http.StatusUnauthorized)
+	executeTemplate(rw, "debug-login", failed)
+}
+
+// debugSession is what the cookie holds once the token has been given.
+func debugSession(token string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(debugTokenCookie))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func validDebugToken(token string, given string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(given)) == 1
+}
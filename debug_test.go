@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugPage(t *testing.T) {
+	recorder, err := NewRecorder("", 2, defaultBackendOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/user/1", "/user/2", "/user/<3>"} {
+		recorder.add(recordedExchange{
+			Time:     time.Now(),
+			Request:  recordedRequest{Method: "PROPFIND", Path: path},
+			Response: recordedResponse{Status: http.StatusMultiStatus, Body: strings.Repeat("x", 2*maxDebugBody)},
+		})
+	}
+	handler := newServerForDebug(recorder, "secret")
+
+	get := func(path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	post := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/debug", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	if rw := get("/debug", nil); rw.Code != http.StatusUnauthorized || !strings.Contains(rw.Body.String(), `name="token"`) {
+		t.Errorf("Incorrect response without token: %v %v", rw.Code, rw.Body.String())
+	}
+	if rw := get("/debug?token=secret", nil); rw.Code != http.StatusUnauthorized {
+		t.Errorf("Token accepted in URL: %v", rw.Code)
+	}
+	if rw := post("wrong"); rw.Code != http.StatusUnauthorized {
+		t.Errorf("Incorrect status for wrong token: %v", rw.Code)
+	}
+
+	rw := post("secret")
+	cookies := rw.Result().Cookies()
+	if rw.Code != http.StatusSeeOther || len(cookies) != 1 {
+		t.Fatalf("Token not remembered: %v %v", rw.Code, cookies)
+	}
+	if strings.Contains(cookies[0].Value, "secret") {
+		t.Errorf("Token stored in cookie: %v", cookies[0].Value)
+	}
+	if rw := get("/debug", &http.Cookie{Name: debugTokenCookie, Value: "secret"}); rw.Code != http.StatusUnauthorized {
+		t.Errorf("Token accepted as cookie: %v", rw.Code)
+	}
+
+	body := get("/debug/exchanges", cookies[0]).Body.String()
+	if strings.Contains(body, "/user/1") || !strings.Contains(body, "/user/2") {
+		t.Errorf("Incorrect exchanges kept: %v", body)
+	}
+	if strings.Contains(body, "/user/<3>") || !strings.Contains(body, "/user/&lt;3&gt;") {
+		t.Errorf("Path not escaped: %v", body)
+	}
+	if strings.Contains(body, strings.Repeat("x", maxDebugBody+1)) {
+		t.Error("Body not truncated")
+	}
+
+	handler = newServerForDebug(recorder, "")
+	if rw := get("/debug?token=", nil); rw.Code != http.StatusNotFound {
+		t.Errorf("Debug page enabled without token: %v", rw.Code)
+	}
+}
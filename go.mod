@@ -3,9 +3,11 @@ module ica-caldav
 go 1.22.1
 
 require (
-	github.com/emersion/go-ical v0.0.0-20240127095438-fc1c9d8fb2b6 // indirect
-	github.com/emersion/go-webdav v0.6.0 // indirect
-	github.com/mitchellh/hashstructure/v2 v2.0.2 // indirect
-	github.com/teambition/rrule-go v1.8.2 // indirect
-	golang.org/x/text v0.21.0 // indirect
+	github.com/BurntSushi/toml v1.4.0
+	github.com/emersion/go-ical v0.0.0-20240127095438-fc1c9d8fb2b6
+	github.com/emersion/go-webdav v0.6.0
+	golang.org/x/crypto v0.31.0
+	golang.org/x/text v0.21.0
 )
+
+require github.com/teambition/rrule-go v1.8.2 // indirect
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"ica-caldav/ica"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const historyFile = "history.json"
+
+// Items that haven't been seen for this long are forgotten, since they've been removed from ICA
+const historyRetention = 90 * 24 * time.Hour
+
+// ItemHistory remembers what ICA doesn't tell us about items: when they were created through us,
+// and when they were striked. Without it we could only guess that an item was completed when it
+// was last updated, which moves whenever the item is changed afterwards.
+type ItemHistory struct {
+	cache ica.Cache
+
+	mu    sync.Mutex
+	items map[string]*itemHistory
+	dirty bool
+}
+
+type itemHistory struct {
+	Created   time.Time `json:"created"`
+	Completed time.Time `json:"completed"`
+	Seen      time.Time `json:"seen"`
+}
+
+// LoadItemHistory reads the history kept in `cache`, starting over if there is none.
+func LoadItemHistory(cache ica.Cache) (*ItemHistory, error) {
+	history := &ItemHistory{cache: cache, items: make(map[string]*itemHistory)}
+	data, err := cache.ReadFile(historyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return history, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &history.items)
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// Created returns when the row was added through us, or zero if we don't know.
+func (h *ItemHistory) Created(row ica.ShoppingListRow) time.Time {
+	if h == nil {
+		return time.Time{}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if item, ok := h.items[row.Id]; ok {
+		return item.Created
+	}
+	return time.Time{}
+}
+
+// Completed returns when the row was striked, or zero if it isn't. It's the time ICA updated the row
+// when Observe first saw it striked, which stays the same however the row changes until it's
+// unstriked. Rows that haven't been observed striked are assumed to be completed when last updated.
+func (h *ItemHistory) Completed(row ica.ShoppingListRow) time.Time {
+	if !row.IsStriked {
+		return time.Time{}
+	}
+	if h != nil {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if item, ok := h.items[row.Id]; ok && !item.Completed.IsZero() {
+			return item.Completed
+		}
+	}
+	return row.Updated
+}
+
+// Observe records the rows of `lists`, as they were just fetched from ICA: when they're first seen
+// striked, and that they're still around.
+func (h *ItemHistory) Observe(lists []ica.ShoppingList, now time.Time) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, list := range lists {
+		for _, row := range list.Rows {
+			item := h.item(row.Id)
+			// Only written when something else changes, since it doesn't need to be exact
+			item.Seen = now
+			switch {
+			case row.IsStriked && item.Completed.IsZero():
+				item.Completed = row.Updated
+				h.dirty = true
+			case !row.IsStriked && !item.Completed.IsZero():
+				item.Completed = time.Time{}
+				h.dirty = true
+			}
+		}
+	}
+}
+
+// Added records that the row was just created by a client.
+func (h *ItemHistory) Added(row ica.ShoppingListRow, now time.Time) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	item := h.item(row.Id)
+	item.Created = now
+	item.Seen = now
+	h.dirty = true
+}
+
+func (h *ItemHistory) item(id string) *itemHistory {
+	item, ok := h.items[id]
+	if !ok {
+		item = &itemHistory{}
+		h.items[id] = item
+		h.dirty = true
+	}
+	return item
+}
+
+// Clear forgets everything, and writes that to the cache right away, e.g. when logging out since
+// the next account has other items.
+func (h *ItemHistory) Clear() error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	h.items = make(map[string]*itemHistory)
+	h.dirty = true
+	h.mu.Unlock()
+	return h.Flush()
+}
+
+// Flush writes the history to the cache, if it has changed.
+func (h *ItemHistory) Flush() error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.dirty {
+		return nil
+	}
+	for id, item := range h.items {
+		if time.Since(item.Seen) > historyRetention {
+			delete(h.items, id)
+		}
+	}
+	data, err := json.Marshal(h.items)
+	if err != nil {
+		return err
+	}
+	err = h.cache.WriteFile(historyFile, data)
+	if err != nil {
+		return err
+	}
+	h.dirty = false
+	return nil
+}
+
+// Run flushes the history every `interval`, so that not much is lost if we're killed without shutting down.
+func (h *ItemHistory) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := h.Flush(); err != nil {
+			slog.Error("Could not write item history",
+				"error", err,
+			)
+		}
+	}
+}
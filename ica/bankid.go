@@ -17,79 +17,139 @@ import (
 type Cache interface {
 	ReadFile(string) ([]byte, error)
 	WriteFile(string, []byte) error
+	Remove(string) error
 }
 
 type BankIDAuthenticator struct {
 	jar    *cookieJar
 	client *http.Client
+
+	mu        sync.Mutex
+	attempts  map[string]*LoginAttempt
+	observers []CallObserver
+	// Called after logging out, to forget what was kept from the session
+	logoutHooks []func()
 }
 
-func NewBankIDAuthentication(cache Cache) BankIDAuthenticator {
+func NewBankIDAuthentication(cache Cache) *BankIDAuthenticator {
 	jar := newCookieJar(cache)
 	client := &http.Client{
 		Jar: jar,
 	}
-	return BankIDAuthenticator{jar, client}
+	return &BankIDAuthenticator{
+		jar:      jar,
+		client:   client,
+		attempts: make(map[string]*LoginAttempt),
+	}
+}
+
+// The different ways of using BankID that IMS supports
+type BankIDMethod string
+
+const (
+	// Scan a QR code with BankID on another device
+	BankIDQRCode BankIDMethod = "icase-bankid-qr"
+	// Open BankID on the same device, through an autostart link
+	BankIDSameDevice BankIDMethod = "icase-bankid-samedevice"
+)
+
+func (m BankIDMethod) url(suffix string) string {
+	return fmt.Sprintf("https://ims.icagruppen.se/authn/authenticate/%v%v", m, suffix)
 }
 
-func (a *BankIDAuthenticator) Start() error {
+var autoStartTokenRegex regexp.Regexp = *regexp.MustCompile(`(?i)autostarttoken["'=:\s]+([0-9a-f-]{36})`)
+
+// Start begins a new BankID login. Every attempt gets its own cookies towards IMS,
+// so that several attempts (e.g. from different browsers) don't interfere with each other.
+func (a *BankIDAuthenticator) Start(method BankIDMethod) (*LoginAttempt, error) {
+	attempt, err := newLoginAttempt(a, method)
+	if err != nil {
+		return nil, err
+	}
+
 	// First we do a preflight, to set some cookies and get redirected properly
-	preflightUrl := "https://ims.icagruppen.se/oauth/v2/authorize?client_id=ica.se&response_type=code&scope=openid+ica-se-scope+ica-se-scope-hard&prompt=login&redirect_uri=https://www.ica.se/logga-in/sso/callback"
+	preflightUrl := authorizeURL("login")
 
 	// FIXME: Probably check status-codes as well?
-	_, err := a.client.Get(preflightUrl)
+	_, err = attempt.client.Get(preflightUrl)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Now we want to start BankID
-	bankIDStartUrl := "https://ims.icagruppen.se/authn/authenticate/icase-bankid-qr"
-	_, err = a.client.Get(bankIDStartUrl)
-	return err
+	resp, err := attempt.client.Get(method.url(""))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if method == BankIDSameDevice {
+		// The page contains the token needed to launch BankID on this device
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		matches := autoStartTokenRegex.FindSubmatch(data)
+		if len(matches) < 2 {
+			return nil, fmt.Errorf("Autostart token not found")
+		}
+		attempt.AutoStartToken = string(matches[1])
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pruneAttempts()
+	a.attempts[attempt.ID] = attempt
+	return attempt, nil
+}
+
+// Attempt returns an ongoing (or recently finished) login attempt, or nil if there's no such attempt.
+func (a *BankIDAuthenticator) Attempt(id string) *LoginAttempt {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pruneAttempts()
+	return a.attempts[id]
 }
 
-func (a *BankIDAuthenticator) Poll() (*time.Time, string, error) {
-	bankIDPollUrl := "https://ims.icagruppen.se/authn/authenticate/icase-bankid-qr/wait"
-	req, err := http.NewRequest("POST", bankIDPollUrl, nil)
+// Forget about attempts that are long gone, must be called with the lock held.
+func (a *BankIDAuthenticator) pruneAttempts() {
+	for id, attempt := range a.attempts {
+		if time.Since(attempt.Created) > loginRetention {
+			delete(a.attempts, id)
+		}
+	}
+}
+
+func pollBankID(client *http.Client, method BankIDMethod) (*bankIDPollResponse, error) {
+	req, err := http.NewRequest("POST", method.url("/wait"), nil)
 	if err != nil {
+		return nil, err
 	}
 	req.Header.Set("Accept", "application/json")
-	resp, err := a.client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
+	defer resp.Body.Close()
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 	var response bankIDPollResponse
 	err = json.Unmarshal(data, &response)
 	if err != nil {
-		return nil, "", err
-	}
-
-	if !response.StopPolling {
-		if len(response.Message.QRCode) == 0 {
-			// Something went wrong?
-			return nil, "", fmt.Errorf("No QR Code")
-		}
-		return nil, response.Message.QRCode, nil
-	}
-
-	// We're done polling, finish up
-	sessionValidity, err := a.finish()
-	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	return sessionValidity, "", nil
+	return &response, nil
 }
 
-func (a *BankIDAuthenticator) finish() (*time.Time, error) {
+// finish completes the login once BankID is done, and moves the resulting session over to the main cookie jar.
+func (a *BankIDAuthenticator) finish(attempt *LoginAttempt) (*time.Time, error) {
 	// Post that we're done, this will return us a html-form with some important values
 	form := url.Values{}
 	form.Set("_pollingDone", "true")
 	payload := bytes.NewBufferString(form.Encode())
-	resp, err := a.client.Post("https://ims.icagruppen.se/authn/authenticate/icase-bankid-qr/launch", "application/x-www-form-urlencoded", payload)
+	resp, err := attempt.client.Post(attempt.Method.url("/launch"), "application/x-www-form-urlencoded", payload)
 	if err != nil {
 		return nil, err
 	}
@@ -100,36 +160,123 @@ func (a *BankIDAuthenticator) finish() (*time.Time, error) {
 		return nil, err
 	}
 
-	_, err = a.client.Do(redirectRequest)
+	_, err = attempt.client.Do(redirectRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify that we got a valid session, before replacing the one we might already have
+	icaURL, err := url.Parse("https://www.ica.se")
 	if err != nil {
 		return nil, err
 	}
+	if attempt.jar.cookie(icaURL, "thSessionId") == nil {
+		return nil, fmt.Errorf("No valid session")
+	}
+	a.jar.merge(attempt.jar)
 
-	// Verify that we have a valid session
 	sessionValidity := a.SessionValidity()
 	if sessionValidity == nil {
 		return nil, fmt.Errorf("No valid session")
 	}
+	return sessionValidity, nil
+}
+
+// Refresh tries to extend the current session without going through BankID again.
+// We first just use the session, which ICA might answer by rotating the `thSessionId` cookie,
+// and if that doesn't help we try a silent re-authorization using the IMS cookies we got when logging in.
+func (a *BankIDAuthenticator) Refresh() (*time.Time, error) {
+	before := a.SessionValidity()
+	if before == nil {
+		return nil, fmt.Errorf("No valid session to refresh")
+	}
+
+	resp, err := a.client.Get(userInformationURL)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slog.Info("Keep-alive failed",
+			"status", resp.StatusCode,
+		)
+	}
+
+	after := a.SessionValidity()
+	if after == nil || !after.After(*before) {
+		// `prompt=none` makes IMS redirect straight back to ICA, as long as its own session is still alive
+		resp, err = a.client.Get(authorizeURL("none"))
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		after = a.SessionValidity()
+	}
+
+	if after == nil {
+		return nil, fmt.Errorf("Session was lost while refreshing")
+	}
 
 	err = a.jar.Persist()
 	if err != nil {
-		slog.Error("Error writing cache", err)
+		slog.Error("Error writing cache",
+			"error", err,
+		)
 	}
+	if !after.After(*before) {
+		return after, fmt.Errorf("Session could not be extended")
+	}
+	return after, nil
+}
 
-	return sessionValidity, nil
+// Persist writes the session to the cache, e.g. before shutting down.
+func (a *BankIDAuthenticator) Persist() error {
+	return a.jar.Persist()
 }
 
-func (a *BankIDAuthenticator) HasStarted() bool {
-	if a.SessionValidity() != nil {
-		return true
-	} else {
-		imsURL, err := url.Parse("https://ims.icagruppen.se")
+// Logout ends the session, both at ICA/IMS and locally.
+// Ending it remotely is best effort, so that we can always get rid of a session we don't want anymore.
+func (a *BankIDAuthenticator) Logout() error {
+	for _, logoutURL := range []string{
+		"https://www.ica.se/logga-ut/",
+		"https://ims.icagruppen.se/oauth/v2/logout?client_id=ica.se&post_logout_redirect_uri=https://www.ica.se/",
+	} {
+		resp, err := a.client.Get(logoutURL)
 		if err != nil {
-			return false
+			slog.Warn("Could not log out remotely",
+				"url", logoutURL,
+				"error", err,
+			)
+			continue
 		}
-		cookies := a.client.Jar.Cookies(imsURL)
-		return len(cookies) != 0
+		resp.Body.Close()
+	}
+
+	a.mu.Lock()
+	for id, attempt := range a.attempts {
+		attempt.Cancel()
+		delete(a.attempts, id)
 	}
+	hooks := a.logoutHooks
+	a.mu.Unlock()
+
+	err := a.jar.clear()
+	for _, hook := range hooks {
+		hook()
+	}
+	return err
+}
+
+// OnLogout registers `hook` to be called after logging out, e.g. to clear what was cached from the
+// session, since the next login may be to another account.
+func (a *BankIDAuthenticator) OnLogout(hook func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.logoutHooks = append(a.logoutHooks, hook)
+}
+
+func authorizeURL(prompt string) string {
+	return fmt.Sprintf("https://ims.icagruppen.se/oauth/v2/authorize?client_id=ica.se&response_type=code&scope=openid+ica-se-scope+ica-se-scope-hard&prompt=%v&redirect_uri=https://www.ica.se/logga-in/sso/callback", prompt)
 }
 
 func (a *BankIDAuthenticator) SessionValidity() *time.Time {
@@ -145,7 +292,23 @@ func (a *BankIDAuthenticator) GetSession() (*ICA, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &ICA{sessionId: cookie.Value}, nil
+	return &ICA{sessionId: cookie.Value, observer: a.observe}, nil
+}
+
+// Observe registers an observer for all calls made to ICA by sessions from this authenticator.
+func (a *BankIDAuthenticator) Observe(observer CallObserver) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.observers = append(a.observers, observer)
+}
+
+func (a *BankIDAuthenticator) observe(call Call) {
+	a.mu.Lock()
+	observers := a.observers
+	a.mu.Unlock()
+	for _, observer := range observers {
+		observer(call)
+	}
 }
 
 func (a *BankIDAuthenticator) getSessionCookie() (*http.Cookie, error) {
@@ -154,10 +317,9 @@ func (a *BankIDAuthenticator) getSessionCookie() (*http.Cookie, error) {
 	if err != nil {
 		return nil, err
 	}
-	for _, cookie := range a.client.Jar.Cookies(icaURL) {
-		if cookie.Name == "thSessionId" {
-			return cookie, cookie.Valid()
-		}
+	cookie := a.jar.cookie(icaURL, "thSessionId")
+	if cookie != nil {
+		return cookie, cookie.Valid()
 	}
 	// No valid cookie, error out
 	return nil, fmt.Errorf("No valid cookie returned")
@@ -207,77 +369,65 @@ func parseRedirectRequest(resp *http.Response) (*http.Request, error) {
 	return req, nil
 }
 
+// The response from polling IMS, which mostly mirrors the BankID `collect` response.
 type bankIDPollResponse struct {
 	StopPolling bool                      `json:"stopPolling"`
+	Status      string                    `json:"status"`
+	HintCode    string                    `json:"hintCode"`
 	Message     bankIDPollResponseMessage `json:"message"`
 }
 
 type bankIDPollResponseMessage struct {
-	QRCode string `json:"qrCode"`
+	QRCode        string `json:"qrCode"`
+	Status        string `json:"status"`
+	HintCode      string `json:"hintCode"`
+	StatusMessage string `json:"statusMessage"`
+	ErrorMessage  string `json:"errorMessage"`
 }
 
-type cookieJar struct {
-	sync.Mutex
-
-	cache   Cache
-	cookies map[string]http.Cookie
-}
+const (
+	bankIDStatusPending  = "pending"
+	bankIDStatusFailed   = "failed"
+	bankIDStatusComplete = "complete"
+)
 
-func newCookieJar(cache Cache) *cookieJar {
-	jar := cookieJar{
-		cache:   cache,
-		cookies: make(map[string]http.Cookie, 0),
+func (r *bankIDPollResponse) status() string {
+	if r.Status != "" {
+		return r.Status
 	}
-
-	// Try reading cookies from session file
-	slog.Info("Starting read")
-	data, err := cache.ReadFile("session.json")
-	slog.Info("Read done")
-	if err != nil {
-		slog.Info("No cached session found",
-			"error", err,
-		)
-		return &jar
-	}
-	var cookies []*http.Cookie
-	err = json.Unmarshal(data, &cookies)
-	if err != nil {
-		slog.Info("Corrupt cache found", err)
-		return &jar
-	}
-	for _, cookie := range cookies {
-		jar.cookies[cookie.Name] = *cookie
-	}
-	return &jar
+	return r.Message.Status
 }
 
-func (j *cookieJar) SetCookies(url *url.URL, cookies []*http.Cookie) {
-	j.Lock()
-	defer j.Unlock()
-	for _, cookie := range cookies {
-		j.cookies[cookie.Name] = *cookie
+func (r *bankIDPollResponse) hintCode() string {
+	if r.HintCode != "" {
+		return r.HintCode
 	}
+	return r.Message.HintCode
 }
 
-func (j *cookieJar) Cookies(url *url.URL) []*http.Cookie {
-	cookies := make([]*http.Cookie, 0)
-	for name := range j.cookies {
-		cookie := j.cookies[name]
-		cookies = append(cookies, &cookie)
+// state maps the response to where in the login we are, or to the error that made it fail.
+// Completed logins still need to be finished, so they are reported as `LoginCompleted` without a session.
+func (r *bankIDPollResponse) state(method BankIDMethod) (LoginState, error) {
+	hintCode := r.hintCode()
+	if r.status() == bankIDStatusFailed || isFailureHintCode(hintCode) {
+		message := r.Message.ErrorMessage
+		if message == "" {
+			message = r.Message.StatusMessage
+		}
+		return LoginFailed, &BankIDError{HintCode: hintCode, Message: message}
 	}
-	return cookies
-}
-
-func (j *cookieJar) Persist() error {
-	icaURL, err := url.Parse("https://www.ica.se")
-	if err != nil {
-		return err
+	if r.StopPolling || r.status() == bankIDStatusComplete {
+		return LoginCompleted, nil
 	}
-	// Write cookies to session file
-	cookies := j.Cookies(icaURL)
-	data, err := json.Marshal(cookies)
-	if err != nil {
-		return err
+	switch hintCode {
+	case HintUserSign, HintUserMrtd, HintUserCallConfirm:
+		return LoginUserSigning, nil
+	case HintOutstandingTransaction, HintNoClient, HintStarted:
+		return LoginAwaitingScan, nil
+	}
+	if method == BankIDQRCode && len(r.Message.QRCode) == 0 {
+		// Without any hint, the QR code disappearing is our best bet that it's been scanned
+		return LoginUserSigning, nil
 	}
-	return j.cache.WriteFile("session.json", data)
+	return LoginAwaitingScan, nil
 }
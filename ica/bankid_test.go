@@ -0,0 +1,119 @@
+package ica
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// refreshTransport answers the calls made by Refresh, recording which were made
+type refreshTransport struct {
+	calls []string
+	// Set as the new `thSessionId` when IMS re-authorizes us, nothing is set if zero
+	extendTo time.Time
+}
+
+func (t *refreshTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls = append(t.calls, fmt.Sprintf("%v %v%v", req.Method, req.URL.Host, req.URL.Path))
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}
+	switch {
+	case req.URL.String() == userInformationURL:
+		// The session is used, but not rotated
+		resp.StatusCode = http.StatusUnauthorized
+	case req.URL.String() == authorizeURL("none") && !t.extendTo.IsZero():
+		resp.StatusCode = http.StatusFound
+		resp.Header.Set("Location", "https://www.ica.se/logga-in/sso/callback?code=abc")
+	case req.URL.Path == "/logga-in/sso/callback":
+		cookie := &http.Cookie{Name: "thSessionId", Value: "refreshed", Path: "/", Expires: t.extendTo}
+		resp.Header.Add("Set-Cookie", cookie.String())
+	}
+	return resp, nil
+}
+
+func newRefreshAuthenticator(t *testing.T, transport *refreshTransport, validUntil time.Time) (*BankIDAuthenticator, *memoryCache) {
+	cache := newMemoryCache()
+	authenticator := NewBankIDAuthentication(cache)
+	authenticator.client.Transport = transport
+	authenticator.jar.SetCookies(mustParse(t, "https://www.ica.se/"), []*http.Cookie{
+		{Name: "thSessionId", Value: "original", Path: "/", Expires: validUntil},
+	})
+	return authenticator, cache
+}
+
+func TestRefresh(t *testing.T) {
+	validUntil := time.Now().Add(time.Hour).Truncate(time.Second)
+	transport := &refreshTransport{extendTo: validUntil.Add(24 * time.Hour)}
+	authenticator, cache := newRefreshAuthenticator(t, transport, validUntil)
+
+	after, err := authenticator.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.Equal(transport.extendTo) {
+		t.Errorf("Incorrect validity: %v", after)
+	}
+	expected := []string{
+		"GET www.ica.se/api/user/information",
+		"GET ims.icagruppen.se/oauth/v2/authorize",
+		"GET www.ica.se/logga-in/sso/callback",
+	}
+	if strings.Join(transport.calls, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Incorrect calls: %v", transport.calls)
+	}
+	if session, err := authenticator.GetSession(); err != nil || session.sessionId != "refreshed" {
+		t.Errorf("Incorrect session: %v %v", session, err)
+	}
+	if !strings.Contains(string(cache.files[sessionFile]), "refreshed") {
+		t.Error("Refreshed session wasn't persisted")
+	}
+}
+
+func TestRefreshFails(t *testing.T) {
+	validUntil := time.Now().Add(time.Hour).Truncate(time.Second)
+	transport := &refreshTransport{}
+	authenticator, _ := newRefreshAuthenticator(t, transport, validUntil)
+
+	after, err := authenticator.Refresh()
+	if err == nil {
+		t.Fatal("Refresh succeeded without a new session")
+	}
+	if after == nil || !after.Equal(validUntil) {
+		t.Errorf("Incorrect validity: %v", after)
+	}
+	if len(transport.calls) != 2 {
+		t.Errorf("Incorrect calls: %v", transport.calls)
+	}
+
+	// Without a session there's nothing to refresh, and nothing is called
+	authenticator, _ = newRefreshAuthenticator(t, transport, time.Now().Add(-time.Hour))
+	if _, err := authenticator.Refresh(); err == nil || len(transport.calls) != 2 {
+		t.Errorf("Refreshed expired session: %v %v", err, transport.calls)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	transport := &refreshTransport{}
+	authenticator, _ := newRefreshAuthenticator(t, transport, time.Now().Add(time.Hour))
+	called := false
+	authenticator.OnLogout(func() {
+		called = true
+	})
+
+	if err := authenticator.Logout(); err != nil {
+		t.Fatal(err)
+	}
+	if !called || authenticator.SessionValidity() != nil {
+		t.Errorf("Not logged out: %v %v", called, authenticator.SessionValidity())
+	}
+	if len(transport.calls) != 2 {
+		t.Errorf("Incorrect calls: %v", transport.calls)
+	}
+}
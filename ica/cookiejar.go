@@ -0,0 +1,418 @@
+package ica
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sessionFile = "session.json"
+
+// A cookie as stored in the jar, scoped according to RFC 6265.
+type cookieEntry struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain"`
+	Path     string    `json:"path"`
+	HostOnly bool      `json:"hostOnly"`
+	Secure   bool      `json:"secure"`
+	HttpOnly bool      `json:"httpOnly"`
+	Expires  time.Time `json:"expires,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+func (e *cookieEntry) key() string {
+	return fmt.Sprintf("%v;%v;%v", e.Domain, e.Path, e.Name)
+}
+
+// Cookies without an expiry are session cookies, we keep those until they're replaced.
+func (e *cookieEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !e.Expires.After(now)
+}
+
+func (e *cookieEntry) matches(u *url.URL, now time.Time) bool {
+	if e.expired(now) {
+		return false
+	}
+	if e.Secure && u.Scheme != "https" {
+		return false
+	}
+	host := canonicalHost(u.Host)
+	if e.HostOnly {
+		if host != e.Domain {
+			return false
+		}
+	} else if !domainMatch(host, e.Domain) {
+		return false
+	}
+	return pathMatch(u.Path, e.Path)
+}
+
+func (e *cookieEntry) cookie() *http.Cookie {
+	return &http.Cookie{
+		Name:     e.Name,
+		Value:    e.Value,
+		Domain:   e.Domain,
+		Path:     e.Path,
+		Secure:   e.Secure,
+		HttpOnly: e.HttpOnly,
+		Expires:  e.Expires,
+	}
+}
+
+type persistedJar struct {
+	Version int           `json:"version"`
+	Cookies []cookieEntry `json:"cookies"`
+}
+
+const persistedJarVersion = 2
+
+type cookieJar struct {
+	sync.RWMutex
+
+	cache   Cache
+	entries map[string]cookieEntry
+	now     func() time.Time
+}
+
+func newCookieJar(cache Cache) *cookieJar {
+	jar := cookieJar{
+		cache:   cache,
+		entries: make(map[string]cookieEntry, 0),
+		now:     time.Now,
+	}
+
+	// Try reading cookies from session file
+	data, err := cache.ReadFile(sessionFile)
+	if err != nil {
+		slog.Info("No cached session found",
+			"error", err,
+		)
+		return &jar
+	}
+	entries, err := decodeJar(data)
+	if err != nil {
+		slog.Info("Corrupt cache found",
+			"error", err,
+		)
+		return &jar
+	}
+	now := jar.now()
+	for _, entry := range entries {
+		if !entry.expired(now) {
+			jar.entries[entry.key()] = entry
+		}
+	}
+	return &jar
+}
+
+// A jar that's only kept in memory, used while logging in.
+func newMemoryJar() *cookieJar {
+	return &cookieJar{
+		entries: make(map[string]cookieEntry, 0),
+		now:     time.Now,
+	}
+}
+
+func decodeJar(data []byte) ([]cookieEntry, error) {
+	var persisted persistedJar
+	err := json.Unmarshal(data, &persisted)
+	if err == nil {
+		return persisted.Cookies, nil
+	}
+
+	// Older versions just stored a list of cookies, without any scoping
+	var legacy []*http.Cookie
+	if json.Unmarshal(data, &legacy) != nil {
+		return nil, err
+	}
+	entries := make([]cookieEntry, 0, len(legacy))
+	for _, cookie := range legacy {
+		entry := cookieEntry{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Domain:   strings.TrimPrefix(strings.ToLower(cookie.Domain), "."),
+			Path:     cookie.Path,
+			Secure:   cookie.Secure,
+			HttpOnly: cookie.HttpOnly,
+			Expires:  cookie.Expires,
+		}
+		if entry.Domain == "" {
+			// We only ever persisted once we had a session on www.ica.se
+			entry.Domain = "www.ica.se"
+			entry.HostOnly = true
+		}
+		if entry.Path == "" {
+			entry.Path = "/"
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (j *cookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Lock()
+	defer j.Unlock()
+
+	now := j.now()
+	host := canonicalHost(u.Host)
+	changed := false
+	for _, cookie := range cookies {
+		entry := cookieEntry{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			Secure:   cookie.Secure,
+			HttpOnly: cookie.HttpOnly,
+			Created:  now,
+		}
+
+		if cookie.Domain == "" {
+			entry.Domain = host
+			entry.HostOnly = true
+		} else {
+			entry.Domain = strings.TrimPrefix(strings.ToLower(cookie.Domain), ".")
+			// Don't accept cookies for other domains, or for top-level domains
+			if !domainMatch(host, entry.Domain) || !strings.Contains(entry.Domain, ".") {
+				slog.Warn("Rejecting cookie for foreign domain",
+					"name", cookie.Name,
+					"domain", cookie.Domain,
+					"host", host,
+				)
+				continue
+			}
+		}
+		if entry.Secure && u.Scheme != "https" {
+			continue
+		}
+		if entry.Path == "" || !strings.HasPrefix(entry.Path, "/") {
+			entry.Path = defaultPath(u.Path)
+		}
+
+		if cookie.MaxAge < 0 {
+			entry.Expires = now
+		} else if cookie.MaxAge > 0 {
+			entry.Expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+		} else {
+			entry.Expires = cookie.Expires
+		}
+
+		key := entry.key()
+		if entry.expired(now) {
+			if _, ok := j.entries[key]; ok {
+				delete(j.entries, key)
+				changed = true
+			}
+			continue
+		}
+		if existing, ok := j.entries[key]; ok {
+			entry.Created = existing.Created
+			if existing == entry {
+				continue
+			}
+		}
+		j.entries[key] = entry
+		changed = true
+	}
+
+	if changed {
+		err := j.persist()
+		if err != nil {
+			slog.Error("Error writing cache",
+				"error", err,
+			)
+		}
+	}
+}
+
+func (j *cookieJar) Cookies(u *url.URL) []*http.Cookie {
+	j.RLock()
+	defer j.RUnlock()
+
+	entries := j.matching(u)
+	cookies := make([]*http.Cookie, 0, len(entries))
+	for _, entry := range entries {
+		cookies = append(cookies, &http.Cookie{Name: entry.Name, Value: entry.Value})
+	}
+	return cookies
+}
+
+// Returns the full cookie (including expiry etc.) that would be sent to `u` with the given name.
+func (j *cookieJar) cookie(u *url.URL, name string) *http.Cookie {
+	j.RLock()
+	defer j.RUnlock()
+
+	for _, entry := range j.matching(u) {
+		if entry.Name == name {
+			return entry.cookie()
+		}
+	}
+	return nil
+}
+
+// Entries that should be sent to `u`, ordered as recommended by RFC 6265, section 5.4.
+func (j *cookieJar) matching(u *url.URL) []cookieEntry {
+	now := j.now()
+	entries := make([]cookieEntry, 0)
+	for _, entry := range j.entries {
+		if entry.matches(u, now) {
+			entries = append(entries, entry)
+		}
+	}
+	slices.SortFunc(entries, func(a, b cookieEntry) int {
+		if len(a.Path) != len(b.Path) {
+			return len(b.Path) - len(a.Path)
+		}
+		return a.Created.Compare(b.Created)
+	})
+	return entries
+}
+
+// Copies all cookies from `other` into this jar, replacing any existing ones with the same scope.
+func (j *cookieJar) merge(other *cookieJar) {
+	other.RLock()
+	entries := make([]cookieEntry, 0, len(other.entries))
+	for _, entry := range other.entries {
+		entries = append(entries, entry)
+	}
+	other.RUnlock()
+
+	j.Lock()
+	defer j.Unlock()
+	for _, entry := range entries {
+		j.entries[entry.key()] = entry
+	}
+	err := j.persist()
+	if err != nil {
+		slog.Error("Error writing cache",
+			"error", err,
+		)
+	}
+}
+
+// Returns all cookies that haven't expired.
+func (j *cookieJar) all() []cookieEntry {
+	j.RLock()
+	defer j.RUnlock()
+	now := j.now()
+	entries := make([]cookieEntry, 0, len(j.entries))
+	for _, entry := range j.entries {
+		if !entry.expired(now) {
+			entries = append(entries, entry)
+		}
+	}
+	slices.SortFunc(entries, func(a, b cookieEntry) int {
+		return strings.Compare(a.key(), b.key())
+	})
+	return entries
+}
+
+// Throws away all current cookies, and uses `entries` instead.
+func (j *cookieJar) replace(entries []cookieEntry) {
+	j.Lock()
+	defer j.Unlock()
+	j.entries = make(map[string]cookieEntry, len(entries))
+	for _, entry := range entries {
+		j.entries[entry.key()] = entry
+	}
+	err := j.persist()
+	if err != nil {
+		slog.Error("Error writing cache",
+			"error", err,
+		)
+	}
+}
+
+// Removes all cookies, including the session file.
+func (j *cookieJar) clear() error {
+	j.Lock()
+	defer j.Unlock()
+	j.entries = make(map[string]cookieEntry, 0)
+	if j.cache == nil {
+		return nil
+	}
+	return j.cache.Remove(sessionFile)
+}
+
+func (j *cookieJar) Persist() error {
+	j.Lock()
+	defer j.Unlock()
+	return j.persist()
+}
+
+// Writes all non-expired cookies to the session file, must be called with the lock held.
+func (j *cookieJar) persist() error {
+	if j.cache == nil {
+		return nil
+	}
+	now := j.now()
+	persisted := persistedJar{
+		Version: persistedJarVersion,
+		Cookies: make([]cookieEntry, 0, len(j.entries)),
+	}
+	for key, entry := range j.entries {
+		if entry.expired(now) {
+			delete(j.entries, key)
+			continue
+		}
+		persisted.Cookies = append(persisted.Cookies, entry)
+	}
+	slices.SortFunc(persisted.Cookies, func(a, b cookieEntry) int {
+		return strings.Compare(a.key(), b.key())
+	})
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+	return j.cache.WriteFile(sessionFile, data)
+}
+
+func canonicalHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// RFC 6265, section 5.1.3
+func domainMatch(host string, domain string) bool {
+	if host == domain {
+		return true
+	}
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	return strings.HasSuffix(host, "."+domain)
+}
+
+// RFC 6265, section 5.1.4
+func defaultPath(path string) string {
+	if path == "" || path[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndex(path, "/")
+	if i == 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+func pathMatch(requestPath string, cookiePath string) bool {
+	if requestPath == "" {
+		requestPath = "/"
+	}
+	if requestPath == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(requestPath, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || requestPath[len(cookiePath)] == '/'
+}
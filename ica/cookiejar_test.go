@@ -0,0 +1,174 @@
+package ica
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type memoryCache struct {
+	files map[string][]byte
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{files: make(map[string][]byte)}
+}
+
+func (c *memoryCache) ReadFile(name string) ([]byte, error) {
+	data, ok := c.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%v not found", name)
+	}
+	return data, nil
+}
+
+func (c *memoryCache) WriteFile(name string, data []byte) error {
+	c.files[name] = data
+	return nil
+}
+
+func (c *memoryCache) Remove(name string) error {
+	delete(c.files, name)
+	return nil
+}
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func cookieValues(cookies []*http.Cookie) map[string]string {
+	values := make(map[string]string)
+	for _, cookie := range cookies {
+		values[cookie.Name] = cookie.Value
+	}
+	return values
+}
+
+func TestCookieJarScopesByDomain(t *testing.T) {
+	jar := newCookieJar(newMemoryCache())
+	ims := mustParse(t, "https://ims.icagruppen.se/authn")
+	ica := mustParse(t, "https://www.ica.se/api")
+
+	jar.SetCookies(ims, []*http.Cookie{{Name: "session", Value: "ims"}})
+	jar.SetCookies(ica, []*http.Cookie{{Name: "session", Value: "ica"}})
+	jar.SetCookies(ica, []*http.Cookie{{Name: "shared", Value: "ica", Domain: ".ica.se"}})
+
+	if values := cookieValues(jar.Cookies(ims)); len(values) != 1 || values["session"] != "ims" {
+		t.Errorf("Incorrect cookies for IMS: %v", values)
+	}
+	if values := cookieValues(jar.Cookies(ica)); len(values) != 2 || values["session"] != "ica" || values["shared"] != "ica" {
+		t.Errorf("Incorrect cookies for ICA: %v", values)
+	}
+	if values := cookieValues(jar.Cookies(mustParse(t, "https://handla.ica.se/"))); len(values) != 1 || values["shared"] != "ica" {
+		t.Errorf("Incorrect cookies for subdomain: %v", values)
+	}
+
+	// Cookies for other domains are rejected
+	jar.SetCookies(ica, []*http.Cookie{{Name: "evil", Value: "1", Domain: "icagruppen.se"}})
+	if values := cookieValues(jar.Cookies(ims)); values["evil"] != "" {
+		t.Errorf("Accepted cookie for foreign domain: %v", values)
+	}
+}
+
+func TestCookieJarPathAndSecure(t *testing.T) {
+	jar := newCookieJar(newMemoryCache())
+	jar.SetCookies(mustParse(t, "https://www.ica.se/logga-in/sso"), []*http.Cookie{
+		{Name: "default", Value: "1"},
+		{Name: "root", Value: "1", Path: "/"},
+		{Name: "secure", Value: "1", Path: "/", Secure: true},
+	})
+
+	if values := cookieValues(jar.Cookies(mustParse(t, "https://www.ica.se/logga-in/callback"))); len(values) != 3 {
+		t.Errorf("Incorrect cookies for matching path: %v", values)
+	}
+	if values := cookieValues(jar.Cookies(mustParse(t, "https://www.ica.se/logga-inte"))); len(values) != 2 || values["default"] != "" {
+		t.Errorf("Incorrect cookies for other path: %v", values)
+	}
+	if values := cookieValues(jar.Cookies(mustParse(t, "http://www.ica.se/"))); len(values) != 1 || values["root"] != "1" {
+		t.Errorf("Incorrect cookies for insecure request: %v", values)
+	}
+}
+
+func TestCookieJarExpiry(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	jar := newCookieJar(newMemoryCache())
+	jar.now = func() time.Time { return now }
+	ica := mustParse(t, "https://www.ica.se/")
+
+	jar.SetCookies(ica, []*http.Cookie{
+		{Name: "maxAge", Value: "1", MaxAge: 60},
+		{Name: "expires", Value: "1", Expires: now.Add(time.Hour)},
+		{Name: "expired", Value: "1", Expires: now.Add(-time.Hour)},
+	})
+	if values := cookieValues(jar.Cookies(ica)); len(values) != 2 || values["expired"] != "" {
+		t.Errorf("Incorrect cookies: %v", values)
+	}
+	if cookie := jar.cookie(ica, "maxAge"); cookie == nil || !cookie.Expires.Equal(now.Add(time.Minute)) {
+		t.Errorf("Max-Age not converted to expiry: %v", cookie)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if values := cookieValues(jar.Cookies(ica)); len(values) != 1 || values["expires"] != "1" {
+		t.Errorf("Expired cookie returned: %v", values)
+	}
+
+	jar.SetCookies(ica, []*http.Cookie{{Name: "expires", Value: "", MaxAge: -1}})
+	if values := cookieValues(jar.Cookies(ica)); len(values) != 0 {
+		t.Errorf("Deleted cookie returned: %v", values)
+	}
+}
+
+func TestCookieJarPersistence(t *testing.T) {
+	cache := newMemoryCache()
+	jar := newCookieJar(cache)
+	ica := mustParse(t, "https://www.ica.se/")
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	jar.SetCookies(ica, []*http.Cookie{{Name: "thSessionId", Value: "abc", Expires: expires}})
+
+	if _, ok := cache.files[sessionFile]; !ok {
+		t.Fatal("Cookies weren't persisted on change")
+	}
+
+	restored := newCookieJar(cache)
+	cookie := restored.cookie(ica, "thSessionId")
+	if cookie == nil || cookie.Value != "abc" || !cookie.Expires.Equal(expires) {
+		t.Errorf("Incorrect restored cookie: %v", cookie)
+	}
+	if values := cookieValues(restored.Cookies(mustParse(t, "https://ims.icagruppen.se/"))); len(values) != 0 {
+		t.Errorf("Restored cookie leaked to other domain: %v", values)
+	}
+}
+
+func TestCookieJarMigratesLegacySession(t *testing.T) {
+	cache := newMemoryCache()
+	cache.files[sessionFile] = []byte(`[{"Name":"thSessionId","Value":"abc","Expires":"2100-01-01T00:00:00Z"}]`)
+	jar := newCookieJar(cache)
+
+	cookie := jar.cookie(mustParse(t, "https://www.ica.se/api/user/information"), "thSessionId")
+	if cookie == nil || cookie.Value != "abc" {
+		t.Errorf("Legacy cookie not migrated: %v", cookie)
+	}
+}
+
+func TestCookieJarClear(t *testing.T) {
+	cache := newMemoryCache()
+	jar := newCookieJar(cache)
+	ica := mustParse(t, "https://www.ica.se/")
+	jar.SetCookies(ica, []*http.Cookie{{Name: "thSessionId", Value: "abc"}})
+
+	if err := jar.clear(); err != nil {
+		t.Fatal(err)
+	}
+	if values := cookieValues(jar.Cookies(ica)); len(values) != 0 {
+		t.Errorf("Cookies left after clearing: %v", values)
+	}
+	if _, ok := cache.files[sessionFile]; ok {
+		t.Error("Session file left after clearing")
+	}
+}
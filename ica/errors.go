@@ -0,0 +1,64 @@
+package ica
+
+import "fmt"
+
+var ErrLoginCancelled = fmt.Errorf("Login was cancelled")
+var ErrLoginExpired = fmt.Errorf("Login timed out")
+
+// Hint codes as returned by BankID, see https://www.bankid.com/utvecklare/guider/teknisk-integrationsguide/graenssnittsbeskrivning/collect
+const (
+	// Pending
+	HintOutstandingTransaction = "outstandingTransaction"
+	HintNoClient               = "noClient"
+	HintStarted                = "started"
+	HintUserMrtd               = "userMrtd"
+	HintUserCallConfirm        = "userCallConfirm"
+	HintUserSign               = "userSign"
+
+	// Failed
+	HintExpiredTransaction = "expiredTransaction"
+	HintCertificateErr     = "certificateErr"
+	HintUserCancel         = "userCancel"
+	HintCancelled          = "cancelled"
+	HintStartFailed        = "startFailed"
+	HintUserDeclinedCall   = "userDeclinedCall"
+)
+
+func isFailureHintCode(hintCode string) bool {
+	switch hintCode {
+	case HintExpiredTransaction, HintCertificateErr, HintUserCancel, HintCancelled, HintStartFailed, HintUserDeclinedCall:
+		return true
+	}
+	return false
+}
+
+// BankIDError is returned when BankID reports that the login failed.
+// Use `errors.Is` with the `ErrBankID...` values to check for specific reasons.
+type BankIDError struct {
+	HintCode string
+	Message  string
+}
+
+func (e *BankIDError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("BankID failed (%v): %v", e.HintCode, e.Message)
+	}
+	if e.HintCode != "" {
+		return fmt.Sprintf("BankID failed (%v)", e.HintCode)
+	}
+	return "BankID failed"
+}
+
+func (e *BankIDError) Is(target error) bool {
+	t, ok := target.(*BankIDError)
+	return ok && t.HintCode == e.HintCode
+}
+
+var (
+	ErrBankIDExpired      = &BankIDError{HintCode: HintExpiredTransaction}
+	ErrBankIDCertificate  = &BankIDError{HintCode: HintCertificateErr}
+	ErrBankIDUserCancel   = &BankIDError{HintCode: HintUserCancel}
+	ErrBankIDCancelled    = &BankIDError{HintCode: HintCancelled}
+	ErrBankIDStartFailed  = &BankIDError{HintCode: HintStartFailed}
+	ErrBankIDDeclinedCall = &BankIDError{HintCode: HintUserDeclinedCall}
+)
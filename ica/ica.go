@@ -2,15 +2,13 @@ package ica
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"time"
-
-	"github.com/mitchellh/hashstructure/v2"
-	"golang.org/x/text/cases"
-	"golang.org/x/text/language"
 )
 
 type SessionProvider interface {
@@ -19,10 +17,44 @@ type SessionProvider interface {
 
 type ICA struct {
 	sessionId string
+	observer  CallObserver
+	// Passed on to ICA, and to observers, to be able to tie calls to the request that caused them
+	requestID string
+	// Used for all calls if set, instead of the default transport
+	transport http.RoundTripper
+}
+
+// WithRequestID returns a copy of the session, that tags all calls with `requestID`.
+func (ica *ICA) WithRequestID(requestID string) *ICA {
+	tagged := *ica
+	tagged.requestID = requestID
+	return &tagged
+}
+
+// WithTransport returns a copy of the session, that sends all calls through `transport`, e.g. to record or fake them.
+func (ica *ICA) WithTransport(transport http.RoundTripper) *ICA {
+	wrapped := *ica
+	wrapped.transport = transport
+	return &wrapped
+}
+
+// Call describes a request made to ICA's API
+type Call struct {
+	// What kind of call this was, e.g. `list/all` or `token`
+	Endpoint  string
+	Method    string
+	RequestID string
+	Status    int
+	Start     time.Time
+	Duration  time.Duration
+	Err       error
 }
 
+// CallObserver is told about every call made to ICA's API, e.g. for monitoring
+type CallObserver func(Call)
+
 func New(sessionId string) ICA {
-	return ICA{sessionId}
+	return ICA{sessionId: sessionId}
 }
 
 func (ica *ICA) setSessionId(sessionId string) {
@@ -36,9 +68,12 @@ type ShoppingListRow struct {
 	Updated   time.Time `json:"updated"`
 }
 
+// ETag changes whenever the row does at ICA, and only then. It's computed from the row as ICA
+// returned it, so it has to be taken before e.g. title-casing the name.
 func (row *ShoppingListRow) ETag() string {
-	hash, _ := hashstructure.Hash(row, hashstructure.FormatV2, nil)
-	return fmt.Sprintf("%v", hash)
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%v\x00%v\x00%v\x00%v", row.Id, row.Name, row.IsStriked, row.Updated.UTC().Format(time.RFC3339Nano))
+	return hex.EncodeToString(hash.Sum(nil)[:16])
 }
 
 type ShoppingList struct {
@@ -49,7 +84,7 @@ type ShoppingList struct {
 }
 
 func (ica *ICA) GetShoppingLists() ([]ShoppingList, error) {
-	data, err := ica.get("shopping-list/v1/api/list/all")
+	data, err := ica.get("list/all", "shopping-list/v1/api/list/all")
 	if err != nil {
 		return nil, err
 	}
@@ -58,13 +93,6 @@ func (ica *ICA) GetShoppingLists() ([]ShoppingList, error) {
 	if err != nil {
 		return nil, err
 	}
-	caser := cases.Title(language.Swedish)
-	for i, list := range lists {
-		for j, row := range list.Rows {
-			list.Rows[j].Name = caser.String(row.Name)
-		}
-		lists[i] = list
-	}
 	return lists, nil
 }
 
@@ -79,7 +107,7 @@ type searchResponse struct {
 
 func (ica *ICA) SearchItem(name string) ([]Suggestion, error) {
 	path := fmt.Sprintf("shoppinglistarticlesearch/v1/search?query=%v", name)
-	data, err := ica.get(path)
+	data, err := ica.get("search", path)
 	if err != nil {
 		return nil, err
 	}
@@ -99,7 +127,7 @@ func (ica *ICA) AddItem(list ShoppingList, item ItemToAdd) (*ShoppingListRow, er
 	if err != nil {
 		return nil, err
 	}
-	data, err = ica.post(path, data)
+	data, err = ica.post("row", path, data)
 	if err != nil {
 		return nil, err
 	}
@@ -108,61 +136,116 @@ func (ica *ICA) AddItem(list ShoppingList, item ItemToAdd) (*ShoppingListRow, er
 	return &row, err
 }
 
-func (ica *ICA) get(path string) ([]byte, error) {
-	url := fmt.Sprintf("https://apimgw-pub.ica.se/sverige/digx/%v", path)
-	req, err := http.NewRequest("GET", url, nil)
+func (ica *ICA) get(endpoint string, path string) ([]byte, error) {
+	req, err := http.NewRequest("GET", APIURL+path, nil)
 	if err != nil {
 		return nil, err
 	}
-	return ica.do(req)
+	return ica.do(endpoint, req)
 }
 
-func (ica *ICA) post(path string, data []byte) ([]byte, error) {
-	url := fmt.Sprintf("https://apimgw-pub.ica.se/sverige/digx/%v", path)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
-	req.Header.Set("Content-Type", "application/json")
+func (ica *ICA) post(endpoint string, path string, data []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", APIURL+path, bytes.NewBuffer(data))
 	if err != nil {
 		return nil, err
 	}
-	return ica.do(req)
+	req.Header.Set("Content-Type", "application/json")
+	return ica.do(endpoint, req)
 }
 
-func (ica *ICA) do(req *http.Request) ([]byte, error) {
-	client := &http.Client{}
+func (ica *ICA) do(endpoint string, req *http.Request) ([]byte, error) {
 	token, err := ica.getToken()
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", token))
+	return ica.send(endpoint, req)
+}
+
+// send performs the request, and tells the observer about it
+func (ica *ICA) send(endpoint string, req *http.Request) ([]byte, error) {
+	client := &http.Client{Transport: ica.transport}
+	call := Call{
+		Endpoint:  endpoint,
+		Method:    req.Method,
+		RequestID: ica.requestID,
+		Start:     time.Now(),
+	}
+	if ica.requestID != "" {
+		req.Header.Set("X-Request-ID", ica.requestID)
+	}
+	var data []byte
 	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	if err == nil {
+		defer resp.Body.Close()
+		call.Status = resp.StatusCode
+		data, err = io.ReadAll(resp.Body)
+		if err == nil && resp.StatusCode >= 400 {
+			err = fmt.Errorf("Unexpected status from ICA: %v", resp.Status)
+		}
+	}
+	call.Duration = time.Since(call.Start)
+	call.Err = err
+	if ica.observer != nil {
+		ica.observer(call)
 	}
-	defer resp.Body.Close()
-	return io.ReadAll(resp.Body)
+	return data, err
 }
 
 func (ica *ICA) getToken() (string, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "https://www.ica.se/api/user/information", nil)
+	data, err := ica.getUserInformation("token")
 	if err != nil {
 		return "", err
 	}
-	req.AddCookie(&http.Cookie{Name: "thSessionId", Value: ica.sessionId})
-	resp, err := client.Do(req)
+	var tokenResponse tokenResponse
+	err = json.Unmarshal(data, &tokenResponse)
+	return tokenResponse.AccessToken, err
+}
+
+// UserInformation is who the session belongs to, as far as ICA tells us.
+type UserInformation struct {
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Email     string `json:"email"`
+}
+
+func (ica *ICA) GetUserInformation() (*UserInformation, error) {
+	data, err := ica.getUserInformation("user")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer resp.Body.Close()
-	data, err := io.ReadAll(resp.Body)
+	var information UserInformation
+	err = json.Unmarshal(data, &information)
+	return &information, err
+}
+
+// The user information is authenticated with the session cookie, and is also where we get tokens for the API.
+func (ica *ICA) getUserInformation(endpoint string) ([]byte, error) {
+	req, err := http.NewRequest("GET", userInformationURL, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	var tokenResponse tokenResponse
-	err = json.Unmarshal(data, &tokenResponse)
-	return tokenResponse.AccessToken, err
+	req.AddCookie(&http.Cookie{Name: "thSessionId", Value: ica.sessionId})
+	return ica.send(endpoint, req)
 }
 
+// verify checks that ICA accepts the session, by fetching a token with it.
+func (ica *ICA) verify() error {
+	token, err := ica.getToken()
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return fmt.Errorf("Session wasn't accepted by ICA")
+	}
+	return nil
+}
+
+// APIURL is where ICA's shopping list API is, it can be changed to e.g. go through a proxy
+var APIURL = "https://apimgw-pub.ica.se/sverige/digx/"
+
+const userInformationURL = "https://www.ica.se/api/user/information"
+
 type tokenResponse struct {
 	AccessToken string `json:"accessToken"`
 }
@@ -0,0 +1,164 @@
+package ica
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type LoginState string
+
+const (
+	LoginStarted      LoginState = "started"
+	LoginAwaitingScan LoginState = "awaiting_scan"
+	LoginUserSigning  LoginState = "user_signing"
+	LoginCompleted    LoginState = "completed"
+	LoginFailed       LoginState = "failed"
+	LoginExpired      LoginState = "expired"
+)
+
+func (s LoginState) Done() bool {
+	return s == LoginCompleted || s == LoginFailed || s == LoginExpired
+}
+
+const (
+	// BankID orders are valid for a few minutes, after that there's no point in polling
+	loginTimeout = 3 * time.Minute
+	// Keep finished attempts around for a while, so that the browser can show the result
+	loginRetention = 10 * time.Minute
+	// Don't poll IMS more often than this, regardless of how many browsers are asking
+	pollInterval = time.Second
+)
+
+// LoginStatus is a snapshot of the state of a LoginAttempt.
+type LoginStatus struct {
+	State      LoginState
+	HintCode   string
+	QRCode     string
+	ValidUntil *time.Time
+	Err        error
+}
+
+// LoginAttempt is one BankID login, from start until it's either completed or has failed.
+type LoginAttempt struct {
+	ID      string
+	Created time.Time
+	Method  BankIDMethod
+	// Used to launch BankID when logging in on the same device
+	AutoStartToken string
+
+	authenticator *BankIDAuthenticator
+	jar           *cookieJar
+	client        *http.Client
+
+	mu       sync.Mutex
+	status   LoginStatus
+	lastPoll time.Time
+}
+
+func newLoginAttempt(authenticator *BankIDAuthenticator, method BankIDMethod) (*LoginAttempt, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	jar := newMemoryJar()
+	return &LoginAttempt{
+		ID:            hex.EncodeToString(id),
+		Created:       time.Now(),
+		Method:        method,
+		authenticator: authenticator,
+		jar:           jar,
+		client:        &http.Client{Jar: jar},
+		status:        LoginStatus{State: LoginStarted},
+	}, nil
+}
+
+// Status returns the current status, without asking IMS for any updates.
+func (l *LoginAttempt) Status() LoginStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.checkExpiry()
+	return l.status
+}
+
+// Poll asks IMS for the current BankID status and moves the attempt along accordingly.
+// Calls made in quick succession share the same result, so several pollers won't race each other.
+func (l *LoginAttempt) Poll() LoginStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.checkExpiry()
+	if l.status.State.Done() || time.Since(l.lastPoll) < pollInterval {
+		return l.status
+	}
+	l.lastPoll = time.Now()
+
+	response, err := pollBankID(l.client, l.Method)
+	if err != nil {
+		l.fail(err)
+		return l.status
+	}
+
+	state, err := response.state(l.Method)
+	if err != nil {
+		l.fail(err)
+		l.status.HintCode = response.hintCode()
+		return l.status
+	}
+	if state != LoginCompleted {
+		l.status = LoginStatus{
+			State:    state,
+			HintCode: response.hintCode(),
+			QRCode:   response.Message.QRCode,
+		}
+		return l.status
+	}
+
+	// We're done polling, finish up
+	sessionValidity, err := l.authenticator.finish(l)
+	if err != nil {
+		l.fail(err)
+		return l.status
+	}
+	l.status = LoginStatus{State: LoginCompleted, ValidUntil: sessionValidity}
+	return l.status
+}
+
+// Cancel stops the attempt, any further polling will just return the failure.
+func (l *LoginAttempt) Cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.status.State.Done() {
+		l.status = LoginStatus{State: LoginFailed, Err: ErrLoginCancelled}
+	}
+}
+
+// AutoStartLink returns a link that opens BankID on the same device, which then goes to `redirect` when done.
+func (l *LoginAttempt) AutoStartLink(redirect string) string {
+	if l.AutoStartToken == "" {
+		return ""
+	}
+	return fmt.Sprintf("bankid:///?autostarttoken=%v&redirect=%v", l.AutoStartToken, url.QueryEscape(redirect))
+}
+
+// Must be called with the lock held
+func (l *LoginAttempt) checkExpiry() {
+	if !l.status.State.Done() && time.Since(l.Created) > loginTimeout {
+		l.status = LoginStatus{State: LoginExpired, Err: ErrLoginExpired}
+	}
+}
+
+// Must be called with the lock held
+func (l *LoginAttempt) fail(err error) {
+	slog.Warn("Login failed",
+		"attempt", l.ID,
+		"error", err,
+	)
+	l.status = LoginStatus{State: LoginFailed, Err: err}
+}
@@ -0,0 +1,100 @@
+package ica
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLoginAttemptCancel(t *testing.T) {
+	attempt, err := newLoginAttempt(NewBankIDAuthentication(newMemoryCache()), BankIDQRCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := attempt.Status().State; state != LoginStarted {
+		t.Errorf("Incorrect initial state: %v", state)
+	}
+
+	attempt.Cancel()
+	status := attempt.Poll()
+	if status.State != LoginFailed || !errors.Is(status.Err, ErrLoginCancelled) {
+		t.Errorf("Incorrect status after cancel: %v", status)
+	}
+}
+
+func TestLoginAttemptExpires(t *testing.T) {
+	attempt, err := newLoginAttempt(NewBankIDAuthentication(newMemoryCache()), BankIDQRCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempt.Created = time.Now().Add(-loginTimeout - time.Second)
+
+	status := attempt.Poll()
+	if status.State != LoginExpired || !errors.Is(status.Err, ErrLoginExpired) {
+		t.Errorf("Incorrect status after timeout: %v", status)
+	}
+
+	// Expired attempts can't be cancelled anymore
+	attempt.Cancel()
+	if state := attempt.Status().State; state != LoginExpired {
+		t.Errorf("Incorrect state after cancelling expired attempt: %v", state)
+	}
+}
+
+func TestPollResponseState(t *testing.T) {
+	cases := []struct {
+		json  string
+		state LoginState
+		err   error
+	}{
+		{`{"stopPolling":false,"message":{"qrCode":"data:image/png;base64,abc"}}`, LoginAwaitingScan, nil},
+		{`{"stopPolling":false,"message":{}}`, LoginUserSigning, nil},
+		{`{"stopPolling":false,"status":"pending","hintCode":"userSign","message":{}}`, LoginUserSigning, nil},
+		{`{"stopPolling":false,"message":{"status":"pending","hintCode":"noClient","qrCode":"abc"}}`, LoginAwaitingScan, nil},
+		{`{"stopPolling":true,"message":{}}`, LoginCompleted, nil},
+		{`{"stopPolling":true,"status":"failed","hintCode":"userCancel","message":{"errorMessage":"Cancelled"}}`, LoginFailed, ErrBankIDUserCancel},
+		{`{"stopPolling":true,"message":{"status":"failed","hintCode":"expiredTransaction"}}`, LoginFailed, ErrBankIDExpired},
+		{`{"stopPolling":true,"message":{"hintCode":"startFailed"}}`, LoginFailed, ErrBankIDStartFailed},
+	}
+	for _, c := range cases {
+		var response bankIDPollResponse
+		if err := json.Unmarshal([]byte(c.json), &response); err != nil {
+			t.Fatal(err)
+		}
+		state, err := response.state(BankIDQRCode)
+		if state != c.state {
+			t.Errorf("Incorrect state for %v: %v", c.json, state)
+		}
+		if (c.err == nil && err != nil) || (c.err != nil && !errors.Is(err, c.err)) {
+			t.Errorf("Incorrect error for %v: %v", c.json, err)
+		}
+	}
+}
+
+func TestSameDeviceLogin(t *testing.T) {
+	var response bankIDPollResponse
+	if err := json.Unmarshal([]byte(`{"stopPolling":false,"message":{}}`), &response); err != nil {
+		t.Fatal(err)
+	}
+	// There's never a QR code when using the same device, so that's not a sign of anything
+	if state, _ := response.state(BankIDSameDevice); state != LoginAwaitingScan {
+		t.Errorf("Incorrect state: %v", state)
+	}
+
+	page := []byte(`<a href="bankid:///?autostarttoken=0b6cf1a2-7b0a-4b8e-8c1c-8e7f0c6a1d2e&redirect=null">`)
+	matches := autoStartTokenRegex.FindSubmatch(page)
+	if len(matches) < 2 || string(matches[1]) != "0b6cf1a2-7b0a-4b8e-8c1c-8e7f0c6a1d2e" {
+		t.Fatalf("Autostart token not found: %v", matches)
+	}
+
+	attempt, err := newLoginAttempt(NewBankIDAuthentication(newMemoryCache()), BankIDSameDevice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempt.AutoStartToken = string(matches[1])
+	link := attempt.AutoStartLink("http://localhost:5000/")
+	if link != "bankid:///?autostarttoken=0b6cf1a2-7b0a-4b8e-8c1c-8e7f0c6a1d2e&redirect=http%3A%2F%2Flocalhost%3A5000%2F" {
+		t.Errorf("Incorrect autostart link: %v", link)
+	}
+}
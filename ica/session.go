@@ -0,0 +1,93 @@
+package ica
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ExportSession returns all cookies, so that the session can be moved to another instance with ImportSession.
+func (a *BankIDAuthenticator) ExportSession() ([]byte, error) {
+	if a.SessionValidity() == nil {
+		return nil, fmt.Errorf("No valid session to export")
+	}
+	return json.Marshal(persistedJar{
+		Version: persistedJarVersion,
+		Cookies: a.jar.all(),
+	})
+}
+
+// ImportSession replaces the current session with one exported from another instance,
+// as long as it's still valid.
+func (a *BankIDAuthenticator) ImportSession(data []byte) (*time.Time, error) {
+	entries, err := decodeJar(data)
+	if err != nil {
+		return nil, err
+	}
+	jar := newMemoryJar()
+	for _, entry := range entries {
+		if !fromICA(entry) {
+			return nil, fmt.Errorf("Cookie %v for %v%v in import isn't from ICA", entry.Name, entry.Domain, entry.Path)
+		}
+		jar.entries[entry.key()] = entry
+	}
+	return a.importJar(jar)
+}
+
+// Where the session's cookies are from. Imports can't add cookies for anywhere else, which would
+// then be sent there and persisted.
+var sessionDomains = []string{"ica.se", "icagruppen.se"}
+
+func fromICA(entry cookieEntry) bool {
+	if entry.Domain != canonicalHost(entry.Domain) || !strings.HasPrefix(entry.Path, "/") {
+		return false
+	}
+	return slices.ContainsFunc(sessionDomains, func(domain string) bool {
+		return domainMatch(entry.Domain, domain)
+	})
+}
+
+// ImportSessionID replaces the current session with a `thSessionId` copied from a browser.
+// We can't know when it expires, so it's assumed to be valid until `validUntil`.
+func (a *BankIDAuthenticator) ImportSessionID(sessionId string, validUntil time.Time) (*time.Time, error) {
+	jar := newMemoryJar()
+	icaURL, err := url.Parse("https://www.ica.se/")
+	if err != nil {
+		return nil, err
+	}
+	jar.SetCookies(icaURL, []*http.Cookie{{
+		Name:     "thSessionId",
+		Value:    sessionId,
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		Expires:  validUntil,
+	}})
+	return a.importJar(jar)
+}
+
+func (a *BankIDAuthenticator) importJar(jar *cookieJar) (*time.Time, error) {
+	icaURL, err := url.Parse("https://www.ica.se")
+	if err != nil {
+		return nil, err
+	}
+	cookie := jar.cookie(icaURL, "thSessionId")
+	if cookie == nil {
+		return nil, fmt.Errorf("No valid session in import")
+	}
+	if err = cookie.Valid(); err != nil {
+		return nil, err
+	}
+	// Make sure ICA actually accepts it, before throwing away what we have
+	session := New(cookie.Value)
+	if err = session.verify(); err != nil {
+		return nil, err
+	}
+
+	a.jar.replace(jar.all())
+	return a.SessionValidity(), nil
+}
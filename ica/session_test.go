@@ -0,0 +1,40 @@
+package ica
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportSessionRejectsForeignCookies(t *testing.T) {
+	for _, entry := range []cookieEntry{
+		{Name: "tracking", Value: "x", Domain: "evil.example", Path: "/"},
+		{Name: "thSessionId", Value: "x", Domain: "ica.se.evil.example", Path: "/"},
+		{Name: "thSessionId", Value: "x", Domain: "notica.se", Path: "/"},
+		{Name: "thSessionId", Value: "x", Domain: "WWW.ICA.SE", Path: "/"},
+		{Name: "thSessionId", Value: "x", Domain: "www.ica.se", Path: ""},
+	} {
+		cache := newMemoryCache()
+		authenticator := NewBankIDAuthentication(cache)
+		data, _ := json.Marshal(persistedJar{
+			Version: persistedJarVersion,
+			Cookies: []cookieEntry{
+				{Name: "thSessionId", Value: "valid", Domain: "www.ica.se", Path: "/", Expires: time.Now().Add(time.Hour)},
+				entry,
+			},
+		})
+		if _, err := authenticator.ImportSession(data); err == nil || !strings.Contains(err.Error(), "isn't from ICA") {
+			t.Errorf("%v for %q accepted: %v", entry.Name, entry.Domain, err)
+		}
+		if len(authenticator.jar.all()) != 0 || cache.files[sessionFile] != nil {
+			t.Errorf("%q imported", entry.Domain)
+		}
+	}
+
+	for _, domain := range []string{"ica.se", "www.ica.se", "ims.icagruppen.se"} {
+		if !fromICA(cookieEntry{Domain: domain, Path: "/"}) {
+			t.Errorf("%v rejected", domain)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"ica-caldav/ica"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// Headers that give access to something, and should never end up in logs
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", http.CanonicalHeaderKey(csrfHeader)}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withLogging logs every request. With a `bodyLimit`, the first part of request and response bodies are logged as well.
+func withLogging(h http.Handler, bodyLimit int) http.Handler {
+	logFn := func(rw http.ResponseWriter, r *http.Request) {
+		// Re-use the ID from a proxy in front of us, so that it's possible to follow a request through both
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		rw.Header().Set(requestIDHeader, requestID)
+		r = r.WithContext(context.WithValue(r.Context(), "requestID", requestID))
+
+		lrw := LoggingResponseWriter{ResponseWriter: rw}
+		var requestBody *limitedBuffer
+		if bodyLimit > 0 {
+			requestBody = &limitedBuffer{limit: bodyLimit}
+			if !sensitiveBody(r.Header.Get("Content-Type")) {
+				r.Body = readCloser{io.TeeReader(r.Body, requestBody), r.Body}
+			}
+			lrw.body = &limitedBuffer{limit: bodyLimit}
+		}
+		start := time.Now()
+		h.ServeHTTP(&lrw, r)
+
+		timeElapsed := time.Since(start)
+		// log request details
+		attributes := []any{
+			"requestId", requestID,
+			"method", r.Method,
+			"uri", r.RequestURI,
+			"status", lrw.Status(),
+			"bytes", lrw.bytes,
+			"duration", timeElapsed,
+			"userAgent", r.UserAgent(),
+			"remoteAddr", r.RemoteAddr,
+		}
+		if bodyLimit > 0 {
+			attributes = append(attributes,
+				"requestHeaders", redactHeaders(r.Header),
+				"requestBody", requestBody.String(),
+				"responseHeaders", redactHeaders(lrw.Header()),
+				"responseBody", responseBody(lrw),
+			)
+		}
+		slog.Info("Request", attributes...)
+	}
+	return http.HandlerFunc(logFn)
+}
+
+// Logs every call made to ICA, with the ID of the request that caused it.
+func logCall(call ica.Call) {
+	attributes := []any{
+		"requestId", call.RequestID,
+		"endpoint", call.Endpoint,
+		"method", call.Method,
+		"status", call.Status,
+		"duration", call.Duration,
+	}
+	if call.Err != nil {
+		slog.Warn("ICA call failed", append(attributes, "error", call.Err)...)
+	} else {
+		slog.Info("ICA call", attributes...)
+	}
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func requestIDFrom(ctx context.Context) string {
+	requestID, _ := ctx.Value("requestID").(string)
+	return requestID
+}
+
+// sensitiveBody tells whether a body can contain session IDs, passphrases or exported sessions.
+// Those come from the forms and pages of the setup page, while CalDAV is XML and iCalendar.
+func sensitiveBody(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data" || mediaType == "text/html"
+}
+
+func responseBody(lrw LoggingResponseWriter) string {
+	contentType := lrw.Header().Get("Content-Type")
+	// Go sniffs the HTML of the setup page, without setting a Content-Type here
+	if (contentType == "" || sensitiveBody(contentType)) && lrw.body.buf.Len() > 0 {
+		return "[REDACTED]"
+	}
+	return lrw.body.String()
+}
+
+func redactHeaders(headers http.Header) http.Header {
+	redacted := headers.Clone()
+	for _, name := range sensitiveHeaders {
+		if _, ok := redacted[name]; ok {
+			redacted[name] = []string{"[REDACTED]"}
+		}
+	}
+	return redacted
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// limitedBuffer keeps the first `limit` bytes written to it, and silently drops the rest.
+type limitedBuffer struct {
+	limit     int
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	remaining := b.limit - b.buf.Len()
+	if len(p) > remaining {
+		b.truncated = true
+		b.buf.Write(p[:max(remaining, 0)])
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "…"
+	}
+	return b.buf.String()
+}
+
+type LoggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	// Only set when we should capture the body
+	body *limitedBuffer
+}
+
+func (r *LoggingResponseWriter) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Status returns the status code that was sent, which is 200 unless something else was written explicitly.
+func (r *LoggingResponseWriter) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *LoggingResponseWriter) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.body != nil {
+		r.body.Write(b)
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
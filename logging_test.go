@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithLoggingRequestID(t *testing.T) {
+	var seen string
+	handler := withLogging(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		seen = requestIDFrom(r.Context())
+		io.ReadAll(r.Body)
+		rw.WriteHeader(http.StatusCreated)
+	}), 4)
+
+	req := httptest.NewRequest("PUT", "/user/shoppinglists/1/2", strings.NewReader("BEGIN:VCALENDAR"))
+	req.Header.Set(requestIDHeader, "proxy-123")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	if seen != "proxy-123" || rw.Header().Get(requestIDHeader) != "proxy-123" {
+		t.Errorf("Request ID from proxy not used: %v, %v", seen, rw.Header())
+	}
+
+	// Made up IDs are replaced
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(requestIDHeader, "<script>")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if seen == "<script>" || seen == "" {
+		t.Errorf("Invalid request ID used: %v", seen)
+	}
+}
+
+func TestWithLoggingSkipsSetupBodies(t *testing.T) {
+	var logs strings.Builder
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	handler := withLogging(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		executeTemplate(rw, "session", SessionState{Export: "ica-caldav:v1:sealed"})
+	}), 1000)
+	req := httptest.NewRequest("POST", "/session/import", strings.NewReader("thSessionId=secret&passphrase=hunter2"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, secret := range []string{"secret", "hunter2", "sealed"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("%v logged: %v", secret, logs.String())
+		}
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("Authorization", "Basic c2VjcmV0")
+	headers.Set("Cookie", "thSessionId=secret")
+	headers.Set("User-Agent", "Reminders")
+
+	redacted := redactHeaders(headers)
+	if redacted.Get("Authorization") != "[REDACTED]" || redacted.Get("Cookie") != "[REDACTED]" {
+		t.Errorf("Headers not redacted: %v", redacted)
+	}
+	if redacted.Get("User-Agent") != "Reminders" {
+		t.Errorf("Incorrect User-Agent: %v", redacted)
+	}
+	if headers.Get("Authorization") != "Basic c2VjcmV0" {
+		t.Error("Original headers modified")
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	buffer := limitedBuffer{limit: 5}
+	buffer.Write([]byte("abc"))
+	n, _ := buffer.Write([]byte("defgh"))
+	if n != 5 {
+		t.Errorf("Incorrect length written: %v", n)
+	}
+	if buffer.String() != "abcde…" {
+		t.Errorf("Incorrect buffer: %v", buffer.String())
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"ica-caldav/ica"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// Logs in with BankID from the terminal, for when there's no browser around.
+func runLogin(args []string) error {
+	flags := flag.NewFlagSet("login", flag.ExitOnError)
+	cacheOptions := addCacheFlags(flags)
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	cache, err := cacheOptions.open()
+	if err != nil {
+		return err
+	}
+	authenticator := ica.NewBankIDAuthentication(cache)
+	attempt, err := authenticator.Start(ica.BankIDQRCode)
+	if err != nil {
+		return err
+	}
+
+	var lastQRCode, lastHint string
+	for {
+		status := attempt.Poll()
+		var hint string
+		if message := getHintMessage(status); message != nil {
+			hint = message.English
+		}
+		if status.QRCode != lastQRCode || hint != lastHint {
+			// Redraw everything, so that the QR code stays in the same place
+			fmt.Print("\x1b[H\x1b[2J")
+			if status.QRCode != "" {
+				err := renderQRCode(os.Stdout, status.QRCode)
+				if err != nil {
+					return err
+				}
+			}
+			if hint != "" {
+				fmt.Println(hint)
+			}
+			lastQRCode = status.QRCode
+			lastHint = hint
+		}
+
+		switch status.State {
+		case ica.LoginCompleted:
+			fmt.Printf("Logged in, session valid until %v\n", status.ValidUntil.Format("2006-01-02 15:04:05"))
+			return nil
+		case ica.LoginFailed, ica.LoginExpired:
+			return status.Err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Renders a QR code image (as a data URI) as block characters, two modules per character.
+func renderQRCode(w io.Writer, dataURI string) error {
+	_, encoded, found := strings.Cut(dataURI, ";base64,")
+	if !strings.HasPrefix(dataURI, "data:image/") || !found {
+		return fmt.Errorf("Unsupported QR code: %.32v", dataURI)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	modules, err := decodeQRModules(img)
+	if err != nil {
+		return err
+	}
+
+	// Scanners need a light border around the code
+	const quietZone = 2
+	size := len(modules)
+	isDark := func(x int, y int) bool {
+		x -= quietZone
+		y -= quietZone
+		return x >= 0 && y >= 0 && x < size && y < size && modules[y][x]
+	}
+	var out strings.Builder
+	for y := 0; y < size+2*quietZone; y += 2 {
+		// Black on white, regardless of the terminal's colours
+		out.WriteString("\x1b[30;47m")
+		for x := 0; x < size+2*quietZone; x++ {
+			top, bottom := isDark(x, y), isDark(x, y+1)
+			switch {
+			case top && bottom:
+				out.WriteString("█")
+			case top:
+				out.WriteString("▀")
+			case bottom:
+				out.WriteString("▄")
+			default:
+				out.WriteString(" ")
+			}
+		}
+		out.WriteString("\x1b[0m\n")
+	}
+	_, err = io.WriteString(w, out.String())
+	return err
+}
+
+// Turns an image of a QR code back into its modules, by finding the top-left finder pattern
+// (which is always 7 modules wide) and sampling the center of each module.
+func decodeQRModules(img image.Image) ([][]bool, error) {
+	bounds := img.Bounds()
+	dark := func(x int, y int) bool {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return (r+g+b)/3 < 0x8000
+	}
+
+	// Find the bounding box of the code
+	minX, minY, maxX, maxY := bounds.Max.X, bounds.Max.Y, bounds.Min.X-1, bounds.Min.Y-1
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if dark(x, y) {
+				minX, minY = min(minX, x), min(minY, y)
+				maxX, maxY = max(maxX, x), max(maxY, y)
+			}
+		}
+	}
+	if maxX < minX {
+		return nil, fmt.Errorf("No QR code found in image")
+	}
+
+	finderWidth := 0
+	for x := minX; x <= maxX && dark(x, minY); x++ {
+		finderWidth++
+	}
+	moduleSize := float64(finderWidth) / 7
+	size := int(math.Round(float64(maxX-minX+1) / moduleSize))
+	if moduleSize < 1 || size < 21 {
+		return nil, fmt.Errorf("Could not find QR code modules")
+	}
+
+	modules := make([][]bool, size)
+	for row := range modules {
+		modules[row] = make([]bool, size)
+		for col := range modules[row] {
+			x := minX + int((float64(col)+0.5)*moduleSize)
+			y := minY + int((float64(row)+0.5)*moduleSize)
+			modules[row][col] = dark(x, y)
+		}
+	}
+	return modules, nil
+}
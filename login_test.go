@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// Draws modules as an image, the way IMS would, with a border and several pixels per module.
+func drawModules(modules [][]bool, scale int, border int) image.Image {
+	size := len(modules)*scale + 2*border
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+	for row := range modules {
+		for col := range modules[row] {
+			if !modules[row][col] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetGray(border+col*scale+dx, border+row*scale+dy, color.Gray{Y: 0})
+				}
+			}
+		}
+	}
+	return img
+}
+
+func testModules() [][]bool {
+	const size = 21
+	modules := make([][]bool, size)
+	for row := range modules {
+		modules[row] = make([]bool, size)
+	}
+	finder := func(top int, left int) {
+		for y := 0; y < 7; y++ {
+			for x := 0; x < 7; x++ {
+				edge := y == 0 || y == 6 || x == 0 || x == 6
+				center := y >= 2 && y <= 4 && x >= 2 && x <= 4
+				modules[top+y][left+x] = edge || center
+			}
+		}
+	}
+	finder(0, 0)
+	finder(0, size-7)
+	finder(size-7, 0)
+	// Some data
+	for i := 8; i < size; i += 2 {
+		modules[i][i] = true
+		modules[10][i] = true
+	}
+	return modules
+}
+
+func TestDecodeQRModules(t *testing.T) {
+	expected := testModules()
+	modules, err := decodeQRModules(drawModules(expected, 5, 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(modules) != len(expected) {
+		t.Fatalf("Incorrect size: %v", len(modules))
+	}
+	for row := range expected {
+		for col := range expected[row] {
+			if modules[row][col] != expected[row][col] {
+				t.Errorf("Incorrect module at %v,%v", col, row)
+			}
+		}
+	}
+}
+
+func TestRenderQRCode(t *testing.T) {
+	var data bytes.Buffer
+	if err := png.Encode(&data, drawModules(testModules(), 4, 8)); err != nil {
+		t.Fatal(err)
+	}
+	dataURI := "data:image/png;base64," + base64.StdEncoding.EncodeToString(data.Bytes())
+
+	var out bytes.Buffer
+	if err := renderQRCode(&out, dataURI); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	// 21 modules plus the quiet zone, two rows per line
+	if len(lines) != 13 {
+		t.Errorf("Incorrect number of lines: %v", len(lines))
+	}
+	// The top of the finder patterns
+	if !strings.Contains(lines[1], "  █▀▀▀▀▀█  ") {
+		t.Errorf("Finder pattern not rendered: %q", lines[1])
+	}
+
+	if err := renderQRCode(&out, "bankid.abc.1.def"); err == nil {
+		t.Error("Expected error for non-image QR code")
+	}
+}
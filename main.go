@@ -1,53 +1,240 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"flag"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"ica-caldav/ica"
-	"io"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"slices"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/emersion/go-webdav"
 	"github.com/emersion/go-webdav/caldav"
 )
 
 func main() {
-	cacheDir := flag.String("cachePath", ".cache", "Path where we save session-data etc")
-	port := flag.String("port", "5000", "HTTP port to use")
-	flag.Parse()
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		// Keep the output readable for humans when running commands
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+		err := runCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	config, err := loadConfig(os.Args[0], os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	ica.APIURL = strings.TrimSuffix(config.APIURL, "/") + "/"
 
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 	slog.SetDefault(logger)
 
-	cache := CacheFS{*cacheDir}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// Let a second signal kill us, if shutting down takes too long
+	context.AfterFunc(ctx, stop)
+
+	cache, err := config.Cache.open()
+	if err != nil {
+		log.Fatal(err)
+	}
 	authenticator := ica.NewBankIDAuthentication(cache)
+	monitor := &Monitor{}
+	authenticator.Observe(monitor.ObserveCall)
+	metrics := NewMetrics(authenticator)
+	authenticator.Observe(metrics.ObserveCall)
+	authenticator.Observe(logCall)
+	history, err := LoadItemHistory(cache)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go history.Run(ctx, time.Minute)
+	var sharedLists *SharedListCache
+	if config.Backend.ListCacheTTL > 0 {
+		sharedLists = NewSharedListCache(config.Backend.ListCacheTTL)
+	}
+	authenticator.OnLogout(forgetSession(sharedLists, history))
 
-	htmlHandler := newServerForSetup(&authenticator)
-	caldavHandler := withListCache(
-		&authenticator,
-	)
+	var recorder *Recorder
+	caldavHandler := newCalDAVHandler(authenticator, config.Backend, history, sharedLists, metrics.ObserveListCache)
+	if config.Record != "" || config.DebugToken != "" {
+		keep := 0
+		if config.DebugToken != "" {
+			keep = config.DebugHistory
+		}
+		recorder, err = NewRecorder(config.Record, keep, config.Backend)
+		if err != nil {
+			log.Fatal(err)
+		}
+		caldavHandler = recorder.Record(newCalDAVHandler(recorder.Provider(authenticator), config.Backend, history, sharedLists, metrics.ObserveListCache))
+	}
+	htmlHandler := newServerForSetup(authenticator, newServerForDebug(recorder, config.DebugToken), config.SessionTransfer)
+	statusHandler := newServerForStatus(authenticator, monitor, metrics)
+	caldavHandler = metrics.Instrument(monitor.Track(caldavHandler))
 
-	handler := mux(htmlHandler, caldavHandler)
+	handler := mux(htmlHandler, statusHandler, caldavHandler)
+	if config.BasicAuthUser != "" {
+		handler = withBasicAuth(handler, config.BasicAuthUser, config.BasicAuthPassword)
+	}
+
+	if config.RefreshInterval > 0 {
+		go keepAlive(ctx, authenticator, config.RefreshInterval)
+	}
+
+	notifiers, err := buildNotifiers(config.NotifyWebhook, config.NotifyNtfy, config.NotifySMTP)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(notifiers) > 0 {
+		thresholds, err := parseThresholds(config.NotifyBefore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		setupURL := config.PublicURL
+		if setupURL == "" {
+			setupURL = fmt.Sprintf("http://localhost:%v%v/", config.Port, strings.TrimSuffix(config.BasePath, "/"))
+		}
+		watcher := NewSessionWatcher(authenticator, notifiers, thresholds, setupURL)
+		go watcher.Run(ctx, time.Minute)
+	}
+
+	socketMode, _ := parseSocketMode(config.SocketMode)
+	listener, err := listen(config.ListenAddress(), socketMode)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	slog.Info("Starting",
 		"sessionValiditiy", authenticator.SessionValidity(),
+		"address", listener.Addr().String(),
 	)
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", *port), withLogging(handler)))
+	server := &http.Server{
+		Handler: withLogging(withBasePath(handler, config.BasePath, config.TrustProxy), config.LogBodies),
+	}
+	err = serve(ctx, server, listener, config.TLSCert, config.TLSKey, config.ShutdownTimeout)
+	if err != nil {
+		slog.Error("Server stopped",
+			"error", err,
+		)
+	}
+
+	// Cookies may have rotated since they were last written
+	if err := authenticator.Persist(); err != nil {
+		slog.Error("Could not persist session",
+			"error", err,
+		)
+	}
+	if err := history.Flush(); err != nil {
+		slog.Error("Could not write item history",
+			"error", err,
+		)
+	}
+	if recorder != nil {
+		recorder.Close()
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+	slog.Info("Stopped")
+}
+
+func runCommand(command string, args []string) error {
+	switch command {
+	case "login":
+		return runLogin(args)
+	case "session":
+		return runSession(args)
+	case "logout":
+		return runLogout(args)
+	case "replay":
+		return runReplay(args)
+	case "config":
+		return runConfig(args)
+	default:
+		return fmt.Errorf("Unknown command: %v", command)
+	}
 }
 
-func mux(htmlHandler http.Handler, caldavHandler http.Handler) http.Handler {
+// forgetSession returns what to do when logging out: forget lists and items of the account, since
+// the next login may be to another one.
+func forgetSession(shared *SharedListCache, history *ItemHistory) func() {
+	return func() {
+		shared.clear()
+		if err := history.Clear(); err != nil {
+			slog.Error("Could not clear item history",
+				"error", err,
+			)
+		}
+	}
+}
+
+// Periodically refreshes the session, so that it hopefully never expires.
+func keepAlive(ctx context.Context, authenticator *ica.BankIDAuthenticator, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if authenticator.SessionValidity() == nil {
+			continue
+		}
+		validUntil, err := authenticator.Refresh()
+		if err != nil {
+			slog.Warn("Could not refresh session",
+				"validUntil", validUntil,
+				"error", err,
+			)
+		} else {
+			slog.Info("Refreshed session",
+				"validUntil", validUntil,
+			)
+		}
+	}
+}
+
+func buildNotifiers(webhookURL string, ntfyURL string, smtpURL string) ([]Notifier, error) {
+	notifiers := make([]Notifier, 0)
+	if webhookURL != "" {
+		notifiers = append(notifiers, WebhookNotifier{webhookURL})
+	}
+	if ntfyURL != "" {
+		notifiers = append(notifiers, NtfyNotifier{ntfyURL})
+	}
+	if smtpURL != "" {
+		notifier, err := NewSMTPNotifier(smtpURL)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	return notifiers, nil
+}
+
+func mux(htmlHandler http.Handler, statusHandler http.Handler, caldavHandler http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		// Use caldav handler if it's a `/user` path, or a non-supported html method
+		if isStatusPath(r.URL.Path) {
+			statusHandler.ServeHTTP(rw, r)
+			return
+		}
+		// Use caldav handler if it's a `/user` path, discovery, or a non-supported html method
 		htmlMethods := []string{http.MethodGet, http.MethodPost}
-		if strings.HasPrefix(r.URL.Path, "/user") || !slices.Contains(htmlMethods, r.Method) {
+		if strings.HasPrefix(r.URL.Path, "/user") || r.URL.Path == "/.well-known/caldav" || !slices.Contains(htmlMethods, r.Method) {
 			caldavHandler.ServeHTTP(rw, r)
 		} else {
 			htmlHandler.ServeHTTP(rw, r)
@@ -55,85 +242,73 @@ func mux(htmlHandler http.Handler, caldavHandler http.Handler) http.Handler {
 	})
 }
 
-func withListCache(provider ica.SessionProvider) http.Handler {
+// newCalDAVHandler serves CalDAV from the sessions of `provider`. `shared` keeps lists between
+// requests, and may be nil to fetch them for every request.
+func newCalDAVHandler(provider ica.SessionProvider, options BackendOptions, history *ItemHistory, shared *SharedListCache, observeCache func(hit bool)) http.Handler {
+	return withDiscovery(withCalendarDataValidation(withListCache(provider, options, history, shared, observeCache), options), provider)
+}
+
+func withListCache(provider ica.SessionProvider, options BackendOptions, history *ItemHistory, shared *SharedListCache, observeCache func(hit bool)) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		session, err := provider.GetSession()
 		if err != nil {
-			// Handle error here, now we just timeout?
+			slog.Warn("No valid session, rejecting CalDAV request",
+				"requestId", requestIDFrom(r.Context()),
+				"error", err,
+			)
+			serveSessionUnavailable(rw, r)
 			return
 		} else {
-			backend := NewIcaBackend(session)
-			handler := caldav.Handler{Backend: backend}
+			session = session.WithRequestID(requestIDFrom(r.Context()))
+			// go-webdav only strips the prefix when resolving what a path is, so the backend gets and returns full paths
+			prefix := basePathFrom(r.Context())
+			backend := NewIcaBackend(session, options, prefix, history)
+			handler := caldav.Handler{Backend: backend, Prefix: prefix}
 			// Send in a list-cache, for performance
-			newContext := context.WithValue(r.Context(), "listCache", ListCache{ica: session})
-			handler.ServeHTTP(rw, r.WithContext(newContext))
+			newContext := context.WithValue(r.Context(), "listCache", &ListCache{ica: session, observe: observeCache, shared: shared, history: history})
+			r = r.Clone(newContext)
+			r.URL.Path = prefix + r.URL.Path
+			if r.Method == http.MethodDelete {
+				// go-webdav only passes these on for PUT
+				err := backend.CheckPreconditions(r.Context(), r.URL.Path, webdav.ConditionalMatch(r.Header.Get("If-Match")), webdav.ConditionalMatch(r.Header.Get("If-None-Match")))
+				if errors.Is(err, errPreconditionFailed) {
+					http.Error(rw, err.Error(), http.StatusPreconditionFailed)
+					return
+				} else if err != nil {
+					http.Error(rw, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			handler.ServeHTTP(rw, r)
 		}
 	})
 }
 
-func withLogging(h http.Handler) http.Handler {
-	logFn := func(rw http.ResponseWriter, r *http.Request) {
-		lrw := LoggingResponseWriter{rw, ""}
-		body, _ := io.ReadAll(r.Body)
-		r.Body = io.NopCloser(bytes.NewBuffer(body))
-		start := time.Now()
-		h.ServeHTTP(&lrw, r)
-
-		timeElapsed := time.Since(start)
-		// log request details
-		slog.Info("Request",
-			"method", r.Method,
-			"uri", r.RequestURI,
-			"duration", timeElapsed,
-		)
-	}
-	return http.HandlerFunc(logFn)
-}
-
-type LoggingResponseWriter struct {
-	http.ResponseWriter
-	body string
-}
-
-func (r *LoggingResponseWriter) Write(b []byte) (int, error) {
-	r.body += string(b)
-	return r.ResponseWriter.Write(b)
-}
-
-type CacheFS struct {
-	path string
-}
-
-func (fs CacheFS) ReadFile(path string) ([]byte, error) {
-	fullPath := fmt.Sprintf("%v/%v", fs.path, path)
-	return os.ReadFile(fullPath)
-}
+// How long clients should wait before retrying when we don't have a session.
+const sessionRetryAfter = 5 * time.Minute
 
-func (fs CacheFS) WriteFile(path string, b []byte) error {
-	fullPath := fmt.Sprintf("%v/%v", fs.path, path)
-	return os.WriteFile(fullPath, b, os.ModeAppend)
+// serveSessionUnavailable tells CalDAV clients that we're temporarily unable to
+// serve them, pointing them (and anyone reading the body) to the setup page.
+func serveSessionUnavailable(rw http.ResponseWriter, r *http.Request) {
+	setupURL := externalURL(r)
+	rw.Header().Set("Content-Type", "application/xml; charset=\"utf-8\"")
+	rw.Header().Set("Retry-After", fmt.Sprintf("%d", int(sessionRetryAfter.Seconds())))
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	rw.Write([]byte(xml.Header))
+	xml.NewEncoder(rw).Encode(sessionUnavailableError{
+		Expired: sessionExpired{
+			Description: fmt.Sprintf("ICA login expired, open %v to renew", setupURL),
+			SetupURL:    setupURL,
+		},
+	})
 }
 
-type CacheFile struct {
-	name string
+type sessionUnavailableError struct {
+	XMLName xml.Name       `xml:"DAV: error"`
+	Expired sessionExpired `xml:"https://github.com/cheif/ica-caldav session-expired"`
 }
 
-func (f CacheFile) Read(b []byte) (int, error) {
-	log.Println("Reading", len(b))
-	file, err := os.Open(f.name)
-	if err != nil {
-		return 0, err
-	}
-	return file.Read(b)
-}
-
-func (f CacheFile) Write(b []byte) (int, error) {
-	file, err := os.Open(f.name)
-	if err != nil {
-		file, err = os.Create(f.name)
-		if err != nil {
-			return 0, err
-		}
-	}
-	return file.Write(b)
+type sessionExpired struct {
+	Description string `xml:"description"`
+	SetupURL    string `xml:"setup-url"`
 }
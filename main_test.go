@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/xml"
+	"ica-caldav/ica"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServeSessionUnavailable(t *testing.T) {
+	req := httptest.NewRequest("PROPFIND", "http://ica.example/user/calendars/", nil)
+	rec := httptest.NewRecorder()
+	serveSessionUnavailable(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Incorrect status: %v", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "300" {
+		t.Errorf("Incorrect Retry-After: %q", rec.Header().Get("Retry-After"))
+	}
+
+	var body sessionUnavailableError
+	if err := xml.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.XMLName.Space != "DAV:" || body.XMLName.Local != "error" {
+		t.Errorf("Incorrect root element: %v", body.XMLName)
+	}
+	if body.Expired.SetupURL != "http://ica.example/" {
+		t.Errorf("Incorrect setup URL: %q", body.Expired.SetupURL)
+	}
+}
+
+func TestForgetSession(t *testing.T) {
+	shared := NewSharedListCache(time.Hour)
+	shared.set([]ica.ShoppingList{{Id: "list", Name: "Mat"}}, time.Now())
+	history, err := LoadItemHistory(CacheFS{path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := ica.ShoppingListRow{Id: "row", Name: "mjölk"}
+	history.Added(row, time.Now())
+
+	forgetSession(shared, history)()
+	if lists := shared.get(time.Now()); lists != nil {
+		t.Errorf("Lists still cached: %v", lists)
+	}
+	history, err = LoadItemHistory(history.cache)
+	if err != nil || !history.Created(row).IsZero() {
+		t.Errorf("History still kept: %v", err)
+	}
+	// Without a shared cache there's only the history to forget
+	forgetSession(nil, history)()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"ica-caldav/ica"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Same buckets as the Prometheus client libraries use by default
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(durationBuckets))
+	}
+	for i, bound := range durationBuckets {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// Metrics collects what we expose on `/metrics`, in the Prometheus text format.
+// We only need a handful of metrics, so they're kept as plain maps instead of pulling in a client library.
+type Metrics struct {
+	validator sessionValidator
+
+	mu             sync.Mutex
+	caldavRequests map[[2]string]uint64
+	icaDurations   map[string]*histogram
+	icaErrors      map[string]uint64
+	cacheHits      uint64
+	cacheMisses    uint64
+}
+
+func NewMetrics(validator sessionValidator) *Metrics {
+	return &Metrics{
+		validator:      validator,
+		caldavRequests: make(map[[2]string]uint64),
+		icaDurations:   make(map[string]*histogram),
+		icaErrors:      make(map[string]uint64),
+	}
+}
+
+// Instrument counts requests by method and status code.
+func (m *Metrics) Instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// Without a body buffer, nothing of the response is kept
+		lrw := &LoggingResponseWriter{ResponseWriter: rw}
+		h.ServeHTTP(lrw, r)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.caldavRequests[[2]string{r.Method, fmt.Sprint(lrw.Status())}]++
+	})
+}
+
+func (m *Metrics) ObserveCall(call ica.Call) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.icaDurations[call.Endpoint]
+	if !ok {
+		h = &histogram{}
+		m.icaDurations[call.Endpoint] = h
+	}
+	h.observe(call.Duration.Seconds())
+	if call.Err != nil {
+		m.icaErrors[call.Endpoint]++
+	}
+}
+
+func (m *Metrics) ObserveListCache(hit bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if hit {
+		m.cacheHits++
+	} else {
+		m.cacheMisses++
+	}
+}
+
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(rw, time.Now())
+}
+
+func (m *Metrics) write(w io.Writer, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP ica_caldav_requests_total CalDAV requests by method and status code.")
+	fmt.Fprintln(w, "# TYPE ica_caldav_requests_total counter")
+	requestKeys := make([][2]string, 0, len(m.caldavRequests))
+	for key := range m.caldavRequests {
+		requestKeys = append(requestKeys, key)
+	}
+	slices.SortFunc(requestKeys, func(a, b [2]string) int {
+		return strings.Compare(a[0]+" "+a[1], b[0]+" "+b[1])
+	})
+	for _, key := range requestKeys {
+		fmt.Fprintf(w, "ica_caldav_requests_total{method=%q,status=%q} %d\n", key[0], key[1], m.caldavRequests[key])
+	}
+
+	fmt.Fprintln(w, "# HELP ica_caldav_ica_request_duration_seconds Latency of calls to the ICA API by endpoint.")
+	fmt.Fprintln(w, "# TYPE ica_caldav_ica_request_duration_seconds histogram")
+	endpoints := make([]string, 0, len(m.icaDurations))
+	for endpoint := range m.icaDurations {
+		endpoints = append(endpoints, endpoint)
+	}
+	slices.Sort(endpoints)
+	for _, endpoint := range endpoints {
+		h := m.icaDurations[endpoint]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "ica_caldav_ica_request_duration_seconds_bucket{endpoint=%q,le=\"%v\"} %d\n", endpoint, bound, h.buckets[i])
+		}
+		fmt.Fprintf(w, "ica_caldav_ica_request_duration_seconds_bucket{endpoint=%q,le=\"+Inf\"} %d\n", endpoint, h.count)
+		fmt.Fprintf(w, "ica_caldav_ica_request_duration_seconds_sum{endpoint=%q} %v\n", endpoint, h.sum)
+		fmt.Fprintf(w, "ica_caldav_ica_request_duration_seconds_count{endpoint=%q} %d\n", endpoint, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP ica_caldav_ica_errors_total Failed calls to the ICA API by endpoint.")
+	fmt.Fprintln(w, "# TYPE ica_caldav_ica_errors_total counter")
+	for _, endpoint := range endpoints {
+		fmt.Fprintf(w, "ica_caldav_ica_errors_total{endpoint=%q} %d\n", endpoint, m.icaErrors[endpoint])
+	}
+
+	fmt.Fprintln(w, "# HELP ica_caldav_list_cache_requests_total Lookups in the list cache, by whether they were hits.")
+	fmt.Fprintln(w, "# TYPE ica_caldav_list_cache_requests_total counter")
+	fmt.Fprintf(w, "ica_caldav_list_cache_requests_total{result=\"hit\"} %d\n", m.cacheHits)
+	fmt.Fprintf(w, "ica_caldav_list_cache_requests_total{result=\"miss\"} %d\n", m.cacheMisses)
+
+	fmt.Fprintln(w, "# HELP ica_caldav_session_expiry_seconds Seconds until the ICA session expires, 0 if there's no valid session.")
+	fmt.Fprintln(w, "# TYPE ica_caldav_session_expiry_seconds gauge")
+	var expiry float64
+	if validUntil := m.validator.SessionValidity(); validUntil != nil && validUntil.After(now) {
+		expiry = validUntil.Sub(now).Seconds()
+	}
+	fmt.Fprintf(w, "ica_caldav_session_expiry_seconds %v\n", expiry)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"ica-caldav/ica"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	validUntil := now.Add(time.Hour)
+	metrics := NewMetrics(fixedValidity{&validUntil})
+
+	metrics.ObserveCall(ica.Call{Endpoint: "list/all", Duration: 30 * time.Millisecond})
+	metrics.ObserveCall(ica.Call{Endpoint: "list/all", Duration: 2 * time.Second, Err: fmt.Errorf("Timeout")})
+	metrics.ObserveListCache(false)
+	metrics.ObserveListCache(true)
+	metrics.ObserveListCache(true)
+
+	var out bytes.Buffer
+	metrics.write(&out, now)
+	for _, line := range []string{
+		`ica_caldav_ica_request_duration_seconds_bucket{endpoint="list/all",le="0.05"} 1`,
+		`ica_caldav_ica_request_duration_seconds_bucket{endpoint="list/all",le="+Inf"} 2`,
+		`ica_caldav_ica_request_duration_seconds_count{endpoint="list/all"} 2`,
+		`ica_caldav_ica_errors_total{endpoint="list/all"} 1`,
+		`ica_caldav_list_cache_requests_total{result="hit"} 2`,
+		`ica_caldav_list_cache_requests_total{result="miss"} 1`,
+		`ica_caldav_session_expiry_seconds 3600`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Missing %v in:\n%v", line, out.String())
+		}
+	}
+}
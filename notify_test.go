@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseThresholds(t *testing.T) {
+	thresholds, err := parseThresholds("3d, 12h,30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []time.Duration{72 * time.Hour, 12 * time.Hour, 30 * time.Minute}
+	if len(thresholds) != len(expected) {
+		t.Fatalf("Incorrect thresholds: %v", thresholds)
+	}
+	for i := range expected {
+		if thresholds[i] != expected[i] {
+			t.Errorf("Incorrect threshold %v: %v", i, thresholds[i])
+		}
+	}
+
+	if _, err := parseThresholds("xd"); err == nil {
+		t.Error("Expected error for invalid duration")
+	}
+}
+
+func TestSessionWatcherNotifiesOncePerThreshold(t *testing.T) {
+	watcher := NewSessionWatcher(nil, nil, []time.Duration{time.Hour, 24 * time.Hour}, "http://localhost:5000/")
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	validUntil := now.Add(48 * time.Hour)
+
+	if n := watcher.next(&validUntil, now); n != nil {
+		t.Errorf("Unexpected notification before any threshold: %v", n)
+	}
+
+	now = validUntil.Add(-23 * time.Hour)
+	if n := watcher.next(&validUntil, now); n == nil || n.Event != eventSessionExpiring {
+		t.Errorf("Expected expiry notification, got %v", n)
+	}
+	if n := watcher.next(&validUntil, now.Add(time.Minute)); n != nil {
+		t.Errorf("Notified twice for the same threshold: %v", n)
+	}
+
+	now = validUntil.Add(-30 * time.Minute)
+	if n := watcher.next(&validUntil, now); n == nil || n.Event != eventSessionExpiring {
+		t.Errorf("Expected expiry notification for the last threshold, got %v", n)
+	}
+
+	if n := watcher.next(nil, now); n == nil || n.Event != eventSessionInvalid {
+		t.Errorf("Expected invalid notification, got %v", n)
+	}
+	if n := watcher.next(nil, now); n != nil {
+		t.Errorf("Notified twice about invalid session: %v", n)
+	}
+
+	// A renewed session starts over
+	renewed := now.Add(30 * time.Minute)
+	if n := watcher.next(&renewed, now); n == nil || n.Event != eventSessionExpiring {
+		t.Errorf("Expected expiry notification for renewed session, got %v", n)
+	}
+}
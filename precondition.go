@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav/caldav"
+)
+
+// withCalendarDataValidation checks what clients PUT before go-webdav parses it, which would
+// otherwise answer with a plain 400 that clients don't understand, or read a body of any size.
+func withCalendarDataValidation(h http.Handler, options BackendOptions) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			h.ServeHTTP(rw, r)
+			return
+		}
+		if r.ContentLength > options.MaxResourceSize {
+			servePreconditionError(rw, r, caldav.PreconditionMaxResourceSize, fmt.Sprintf("%v bytes", r.ContentLength))
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, options.MaxResourceSize+1))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > options.MaxResourceSize {
+			servePreconditionError(rw, r, caldav.PreconditionMaxResourceSize, "Body too large")
+			return
+		}
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != ical.MIMEType {
+			servePreconditionError(rw, r, caldav.PreconditionSupportedCalendarData, r.Header.Get("Content-Type"))
+			return
+		}
+		if _, err := ical.NewDecoder(bytes.NewReader(body)).Decode(); err != nil {
+			servePreconditionError(rw, r, caldav.PreconditionValidCalendarData, err.Error())
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// preconditionError is returned by the backend when the calendar data can't be stored, and is
+// sent to the client as a CalDAV precondition (RFC 4791 section 5.3.2.1).
+func preconditionError(ctx context.Context, precondition caldav.PreconditionType, reason string) error {
+	logRejection(ctx, precondition, reason)
+	return caldav.NewPreconditionError(precondition)
+}
+
+// servePreconditionError sends the same response as go-webdav does for errors from preconditionError.
+func servePreconditionError(rw http.ResponseWriter, r *http.Request, precondition caldav.PreconditionType, reason string) {
+	logRejection(r.Context(), precondition, reason)
+	rw.Header().Set("Content-Type", "application/xml; charset=\"utf-8\"")
+	rw.WriteHeader(http.StatusConflict)
+	rw.Write([]byte(xml.Header))
+	xml.NewEncoder(rw).Encode(davError{
+		Conditions: []davProperty{{XMLName: xml.Name{Space: caldavNamespace, Local: string(precondition)}}},
+	})
+}
+
+// logRejection logs why calendar data was rejected, since clients only get told which precondition failed.
+func logRejection(ctx context.Context, precondition caldav.PreconditionType, reason string) {
+	slog.Info("Rejecting calendar data",
+		"requestId", requestIDFrom(ctx),
+		"precondition", precondition,
+		"reason", reason,
+	)
+}
+
+type davError struct {
+	XMLName    xml.Name      `xml:"DAV: error"`
+	Conditions []davProperty `xml:",any"`
+}
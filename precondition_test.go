@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCalendarDataPreconditions(t *testing.T) {
+	calendar := func(components string) string {
+		return "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:test\r\n" + components + "END:VCALENDAR\r\n"
+	}
+	todo := func(uid string, summary string) string {
+		return "BEGIN:VTODO\r\nUID:" + uid + "\r\nDTSTAMP:20250101T120000Z\r\n" + summary + "END:VTODO\r\n"
+	}
+
+	fake := &fakeICA{}
+	handler := newCalDAVHandler(replayProvider{fake}, defaultBackendOptions, nil, nil, nil)
+	for _, test := range []struct {
+		name         string
+		path         string
+		contentType  string
+		body         string
+		precondition string
+	}{
+		{"event", "/user/shoppinglists/list/new", "text/calendar", calendar("BEGIN:VEVENT\r\nUID:new\r\nDTSTAMP:20250101T120000Z\r\nEND:VEVENT\r\n"), "supported-calendar-component"},
+		{"invalid", "/user/shoppinglists/list/new", "text/calendar", "BEGIN:VCALENDAR\r\nBEGIN:VTODO\r\n", "valid-calendar-data"},
+		{"invalid due", "/user/shoppinglists/list/new", "text/calendar", calendar(todo("new", "SUMMARY:Bröd\r\nDUE:tomorrow\r\n")), "valid-calendar-data"},
+		{"no summary", "/user/shoppinglists/list/new", "text/calendar", calendar(todo("new", "")), "valid-calendar-data"},
+		{"two items", "/user/shoppinglists/list/new", "text/calendar", calendar(todo("new", "SUMMARY:Bröd\r\n") + todo("other", "SUMMARY:Smör\r\n")), "valid-calendar-object-resource"},
+		{"too large", "/user/shoppinglists/list/new", "text/calendar", calendar(todo("new", "SUMMARY:"+strings.Repeat("Bröd", 250)+"\r\n")), "max-resource-size"},
+		{"content type", "/user/shoppinglists/list/new", "text/plain", calendar(todo("new", "SUMMARY:Bröd\r\n")), "supported-calendar-data"},
+		{"uid conflict", "/user/shoppinglists/list/new", "text/calendar", calendar(todo("row", "SUMMARY:Bröd\r\n")), "no-uid-conflict"},
+	} {
+		fake.expect([]recordedCall{{Method: "GET", URL: listsURL, Status: http.StatusOK, Body: recordedLists}})
+		req := httptest.NewRequest("PUT", test.path, strings.NewReader(test.body))
+		req.Header.Set("Content-Type", test.contentType)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		expected := `<` + test.precondition + ` xmlns="urn:ietf:params:xml:ns:caldav">`
+		if rw.Code != http.StatusConflict || !strings.Contains(rw.Body.String(), expected) {
+			t.Errorf("%v: %v %v", test.name, rw.Code, rw.Body.String())
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"ica-caldav/ica"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const (
+	principalPath       = "/user/"
+	calendarHomeSetPath = "/user/shoppinglists/"
+)
+
+const (
+	davNamespace    = "DAV:"
+	caldavNamespace = "urn:ietf:params:xml:ns:caldav"
+)
+
+// Shown for the account when ICA doesn't tell us the name of the user
+const defaultDisplayName = "ICA"
+
+// withDiscovery answers what CalDAV clients ask for while setting up an account (RFC 6764):
+// `/.well-known/caldav`, and PROPFIND on `/` and the principal. go-webdav answers those too, but
+// doesn't let us fill in e.g. the displayname, and uses the wrong href for `/`. Implementing its
+// `UserPrincipalBackend` only decides the paths: the properties are a fixed set in unexported
+// methods, built from types in its internal package. So these few responses are encoded here,
+// while everything below the principal still goes through go-webdav.
+func withDiscovery(h http.Handler, provider ica.SessionProvider) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.well-known/caldav" {
+			// Doesn't need a session, so that accounts can be set up before logging in to ICA
+			http.Redirect(rw, r, basePathFrom(r.Context())+principalPath, http.StatusMovedPermanently)
+			return
+		}
+		if r.Method != "PROPFIND" || (r.URL.Path != "/" && r.URL.Path != principalPath) {
+			h.ServeHTTP(rw, r)
+			return
+		}
+		depth := r.Header.Get("Depth")
+		if depth == "" || depth == "infinity" {
+			// Everything below the principal, which go-webdav handles
+			h.ServeHTTP(rw, r)
+			return
+		}
+
+		requested, namesOnly, err := parsePropfind(r.Body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p := principal{provider: provider, requestID: requestIDFrom(r.Context()), prefix: basePathFrom(r.Context())}
+		var responses []davResponse
+		if r.URL.Path == "/" {
+			responses = append(responses, newDavResponse(p.prefix+"/", requested, namesOnly, p.rootProperties()))
+		} else {
+			responses = append(responses, newDavResponse(p.prefix+principalPath, requested, namesOnly, p.properties()))
+			if depth == "1" {
+				responses = append(responses, newDavResponse(p.prefix+calendarHomeSetPath, requested, namesOnly, p.homeSetProperties()))
+			}
+		}
+
+		rw.Header().Set("Content-Type", "application/xml; charset=\"utf-8\"")
+		rw.WriteHeader(http.StatusMultiStatus)
+		rw.Write([]byte(xml.Header))
+		xml.NewEncoder(rw).Encode(davMultiStatus{Responses: responses})
+	})
+}
+
+// A property's value, as XML, which is only computed if it's asked for
+type propertyValue func() string
+
+type principal struct {
+	provider  ica.SessionProvider
+	requestID string
+	// Where we're served, which all hrefs start with
+	prefix string
+
+	user    *ica.UserInformation
+	fetched bool
+}
+
+func (p *principal) rootProperties() map[xml.Name]propertyValue {
+	return map[xml.Name]propertyValue{
+		{Space: davNamespace, Local: "resourcetype"}:           constant(`<collection xmlns="DAV:"/>`),
+		{Space: davNamespace, Local: "current-user-principal"}: constant(href(p.prefix + principalPath)),
+	}
+}
+
+func (p *principal) properties() map[xml.Name]propertyValue {
+	return map[xml.Name]propertyValue{
+		{Space: davNamespace, Local: "resourcetype"}:           constant(`<collection xmlns="DAV:"/><principal xmlns="DAV:"/>`),
+		{Space: davNamespace, Local: "current-user-principal"}: constant(href(p.prefix + principalPath)),
+		{Space: davNamespace, Local: "principal-URL"}:          constant(href(p.prefix + principalPath)),
+		{Space: caldavNamespace, Local: "calendar-home-set"}:   constant(href(p.prefix + calendarHomeSetPath)),
+		{Space: davNamespace, Local: "displayname"}: func() string {
+			return escapeXML(p.displayName())
+		},
+		{Space: caldavNamespace, Local: "calendar-user-address-set"}: func() string {
+			addresses := href(p.prefix + principalPath)
+			if user := p.userInformation(); user != nil && user.Email != "" {
+				addresses = href("mailto:"+user.Email) + addresses
+			}
+			return addresses
+		},
+	}
+}
+
+func (p *principal) homeSetProperties() map[xml.Name]propertyValue {
+	return map[xml.Name]propertyValue{
+		{Space: davNamespace, Local: "resourcetype"}:           constant(`<collection xmlns="DAV:"/>`),
+		{Space: davNamespace, Local: "current-user-principal"}: constant(href(p.prefix + principalPath)),
+	}
+}
+
+func (p *principal) displayName() string {
+	user := p.userInformation()
+	if user == nil {
+		return defaultDisplayName
+	}
+	name := strings.TrimSpace(fmt.Sprintf("%v %v", user.FirstName, user.LastName))
+	if name == "" {
+		return defaultDisplayName
+	}
+	return name
+}
+
+// userInformation is fetched from ICA at most once per request, and is nil if that doesn't work.
+func (p *principal) userInformation() *ica.UserInformation {
+	if p.fetched {
+		return p.user
+	}
+	p.fetched = true
+	session, err := p.provider.GetSession()
+	if err != nil {
+		return nil
+	}
+	user, err := session.WithRequestID(p.requestID).GetUserInformation()
+	if err != nil {
+		slog.Warn("Could not get user information",
+			"requestId", p.requestID,
+			"error", err,
+		)
+		return nil
+	}
+	p.user = user
+	return user
+}
+
+func constant(value string) propertyValue {
+	return func() string {
+		return value
+	}
+}
+
+func href(path string) string {
+	return fmt.Sprintf(`<href xmlns="DAV:">%v</href>`, escapeXML(path))
+}
+
+func escapeXML(text string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(text))
+	return escaped.String()
+}
+
+type propfindRequest struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Properties []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+// parsePropfind returns the requested properties, or nil if all of them are. With `propname`,
+// all of them are requested, but only their names should be returned.
+func parsePropfind(body io.Reader) (requested []xml.Name, namesOnly bool, err error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		// An empty body means allprop
+		return nil, false, nil
+	}
+	var request propfindRequest
+	err = xml.Unmarshal(data, &request)
+	if err != nil {
+		return nil, false, fmt.Errorf("Invalid PROPFIND body: %w", err)
+	}
+	switch {
+	case request.PropName != nil:
+		return nil, true, nil
+	case request.AllProp != nil:
+		return nil, false, nil
+	case request.Prop == nil:
+		return nil, false, fmt.Errorf("Invalid PROPFIND body: propname, allprop or prop is needed")
+	}
+	names := make([]xml.Name, 0, len(request.Prop.Properties))
+	for _, property := range request.Prop.Properties {
+		names = append(names, property.XMLName)
+	}
+	return names, false, nil
+}
+
+type davMultiStatus struct {
+	XMLName   xml.Name      `xml:"DAV: multistatus"`
+	Responses []davResponse `xml:"response"`
+}
+
+type davResponse struct {
+	Href      string        `xml:"href"`
+	Propstats []davPropstat `xml:"propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"prop"`
+	Status string  `xml:"status"`
+}
+
+type davProp struct {
+	Properties []davProperty `xml:",any"`
+}
+
+type davProperty struct {
+	XMLName xml.Name
+	Value   string `xml:",innerxml"`
+}
+
+// newDavResponse returns the `requested` properties of `path`, or all of them if nil. With `namesOnly`
+// the properties are empty, and nothing is fetched.
+func newDavResponse(path string, requested []xml.Name, namesOnly bool, properties map[xml.Name]propertyValue) davResponse {
+	if requested == nil {
+		for name := range properties {
+			requested = append(requested, name)
+		}
+	}
+	var found, missing []davProperty
+	for _, name := range requested {
+		if value, ok := properties[name]; ok && namesOnly {
+			found = append(found, davProperty{XMLName: name})
+		} else if ok {
+			found = append(found, davProperty{XMLName: name, Value: value()})
+		} else {
+			missing = append(missing, davProperty{XMLName: name})
+		}
+	}
+
+	response := davResponse{Href: path}
+	if len(found) > 0 {
+		response.Propstats = append(response.Propstats, davPropstat{
+			Prop:   davProp{found},
+			Status: "HTTP/1.1 200 OK",
+		})
+	}
+	if len(missing) > 0 {
+		response.Propstats = append(response.Propstats, davPropstat{
+			Prop:   davProp{missing},
+			Status: "HTTP/1.1 404 Not Found",
+		})
+	}
+	return response
+}
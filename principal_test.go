@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"ica-caldav/ica"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const principalPropfind = `<?xml version="1.0" encoding="UTF-8"?>
+<propfind xmlns="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <prop>
+    <displayname/>
+    <C:calendar-home-set/>
+    <C:calendar-user-address-set/>
+    <getetag/>
+  </prop>
+</propfind>`
+
+func TestWellKnownRedirect(t *testing.T) {
+	handler := newCalDAVHandler(noSession{}, defaultBackendOptions, nil, nil, nil)
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("PROPFIND", "/.well-known/caldav", nil))
+	if rw.Code != http.StatusMovedPermanently || rw.Header().Get("Location") != principalPath {
+		t.Errorf("Incorrect redirect: %v %v", rw.Code, rw.Header())
+	}
+}
+
+func TestPrincipalProperties(t *testing.T) {
+	fake := &fakeICA{}
+	fake.expect([]recordedCall{{
+		Method: "GET",
+		URL:    "https://www.ica.se/api/user/information",
+		Status: http.StatusOK,
+		Body:   `{"firstName":"Anna","lastName":"Andersson","email":"anna@example.com"}`,
+	}})
+	handler := newCalDAVHandler(replayProvider{fake}, defaultBackendOptions, nil, nil, nil)
+
+	req := httptest.NewRequest("PROPFIND", principalPath, strings.NewReader(principalPropfind))
+	req.Header.Set("Depth", "0")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	body := rw.Body.String()
+	if rw.Code != http.StatusMultiStatus {
+		t.Fatalf("Incorrect status: %v %v", rw.Code, body)
+	}
+	for _, expected := range []string{
+		`<href>/user/</href>`,
+		`<displayname xmlns="DAV:">Anna Andersson</displayname>`,
+		`<href xmlns="DAV:">/user/shoppinglists/</href>`,
+		`<href xmlns="DAV:">mailto:anna@example.com</href>`,
+		`<getetag xmlns="DAV:"></getetag></prop><status>HTTP/1.1 404 Not Found</status>`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("%v missing from %v", expected, body)
+		}
+	}
+}
+
+func TestRootPropfind(t *testing.T) {
+	handler := newCalDAVHandler(noSession{}, defaultBackendOptions, nil, nil, nil)
+	req := httptest.NewRequest("PROPFIND", "/", strings.NewReader(`<propfind xmlns="DAV:"><prop><current-user-principal/></prop></propfind>`))
+	req.Header.Set("Depth", "0")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	body := rw.Body.String()
+	if !strings.Contains(body, `<href>/</href>`) || !strings.Contains(body, `<current-user-principal xmlns="DAV:"><href xmlns="DAV:">/user/</href>`) {
+		t.Errorf("Incorrect response: %v", body)
+	}
+}
+
+func TestPropnamePropfind(t *testing.T) {
+	// Nothing is fetched from ICA for names
+	handler := newCalDAVHandler(noSession{}, defaultBackendOptions, nil, nil, nil)
+	req := httptest.NewRequest("PROPFIND", principalPath, strings.NewReader(`<propfind xmlns="DAV:"><propname/></propfind>`))
+	req.Header.Set("Depth", "0")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	body := rw.Body.String()
+	if rw.Code != http.StatusMultiStatus || !strings.Contains(body, `<displayname xmlns="DAV:"></displayname>`) {
+		t.Errorf("Incorrect response: %v %v", rw.Code, body)
+	}
+	if strings.Contains(body, "/user/shoppinglists/") || strings.Contains(body, defaultDisplayName) {
+		t.Errorf("Values returned: %v", body)
+	}
+
+	req = httptest.NewRequest("PROPFIND", principalPath, strings.NewReader(`<propfind xmlns="DAV:"/>`))
+	req.Header.Set("Depth", "0")
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Incorrect status for empty propfind: %v", rw.Code)
+	}
+}
+
+type noSession struct{}
+
+func (noSession) GetSession() (*ica.ICA, error) {
+	return nil, fmt.Errorf("No session")
+}
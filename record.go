@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"ica-caldav/ica"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bodies larger than this are truncated in recordings, CalDAV bodies are usually a lot smaller.
+const maxRecordedBody = 1 << 20
+
+// Bodies kept in memory for the debug page are truncated to this
+const maxDebugBody = 4096
+
+// recordedExchange is a CalDAV request, the response we gave, and the calls to ICA made in between.
+type recordedExchange struct {
+	Time      time.Time        `json:"time"`
+	Duration  time.Duration    `json:"duration"`
+	RequestID string           `json:"requestId"`
+	Request   recordedRequest  `json:"request"`
+	Response  recordedResponse `json:"response"`
+	Calls     []recordedCall   `json:"ica,omitempty"`
+	// What the server was configured with, from the last recordedOptions before the exchange
+	Options *BackendOptions `json:"-"`
+}
+
+// recordedOptions are the settings that decide what responses look like. They're written whenever
+// recording starts, so that a recording replays the same way without the config of the server.
+type recordedOptions struct {
+	TitleCase       bool     `json:"titleCase"`
+	MaxResourceSize int64    `json:"maxResourceSize"`
+	ProductID       string   `json:"productID"`
+	IncludeLists    []string `json:"includeLists,omitempty"`
+	ExcludeLists    []string `json:"excludeLists,omitempty"`
+	Timezone        string   `json:"timezone,omitempty"`
+}
+
+func newRecordedOptions(options BackendOptions) recordedOptions {
+	recorded := recordedOptions{
+		TitleCase:       options.TitleCase,
+		MaxResourceSize: options.MaxResourceSize,
+		ProductID:       options.ProductID,
+		IncludeLists:    options.IncludeLists,
+		ExcludeLists:    options.ExcludeLists,
+	}
+	if options.Timezone != nil {
+		recorded.Timezone = options.Timezone.String()
+	}
+	return recorded
+}
+
+func (o recordedOptions) backendOptions() (BackendOptions, error) {
+	options := defaultBackendOptions
+	options.TitleCase = o.TitleCase
+	options.MaxResourceSize = o.MaxResourceSize
+	options.ProductID = o.ProductID
+	options.IncludeLists = o.IncludeLists
+	options.ExcludeLists = o.ExcludeLists
+	if o.Timezone != "" {
+		location, err := time.LoadLocation(o.Timezone)
+		if err != nil {
+			return options, err
+		}
+		options.Timezone = location
+	}
+	return options, nil
+}
+
+// recordingLine is a line of a recording, which is either an exchange or the options that the
+// exchanges after it were recorded with.
+type recordingLine struct {
+	recordedExchange
+	Options *recordedOptions `json:"options,omitempty"`
+}
+
+type recordedRequest struct {
+	Method string `json:"method"`
+	Host   string `json:"host"`
+	Path   string `json:"path"`
+	// Where the server was served, which Path is relative to
+	BasePath string      `json:"basePath,omitempty"`
+	Headers  http.Header `json:"headers"`
+	Body     string      `json:"body,omitempty"`
+}
+
+type recordedResponse struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body,omitempty"`
+}
+
+type recordedCall struct {
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	Status   int           `json:"status"`
+	Duration time.Duration `json:"duration"`
+	Body     string        `json:"body,omitempty"`
+	// Set when there was no response, e.g. after a timeout, and Status is 0
+	Error string `json:"error,omitempty"`
+}
+
+// Recorder captures CalDAV traffic. It's appended to a JSONL file, to be able to replay it later
+// with `ica-caldav replay`, and/or kept in memory for the debug page.
+type Recorder struct {
+	mu sync.Mutex
+	// Only set when recording to a file
+	file    *os.File
+	encoder *json.Encoder
+	// The most recent exchanges, oldest first
+	recent []recordedExchange
+	keep   int
+	// Calls to ICA, by the ID of the request that caused them
+	calls map[string][]recordedCall
+}
+
+// NewRecorder records to the file at `path` unless it's empty, and keeps the `keep` most recent exchanges in memory.
+// `options` are written to the file first, so that it can be replayed with them.
+func NewRecorder(path string, keep int, options BackendOptions) (*Recorder, error) {
+	rec := &Recorder{
+		keep:  keep,
+		calls: make(map[string][]recordedCall),
+	}
+	if path != "" {
+		// Recordings contain the shopping lists, so keep them as private as the session
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		rec.file = file
+		rec.encoder = json.NewEncoder(file)
+		recorded := newRecordedOptions(options)
+		err = rec.encoder.Encode(recordingLine{Options: &recorded})
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+func (rec *Recorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.file == nil {
+		return nil
+	}
+	return rec.file.Close()
+}
+
+// Recent returns the exchanges kept in memory, most recent first.
+func (rec *Recorder) Recent() []recordedExchange {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	recent := slices.Clone(rec.recent)
+	slices.Reverse(recent)
+	return recent
+}
+
+func (rec *Recorder) add(exchange recordedExchange) {
+	if rec.encoder != nil {
+		rec.encoder.Encode(exchange)
+	}
+	if rec.keep > 0 {
+		// Bodies can be large, and the debug page only needs to give an idea of what they were
+		exchange.Request.Body = truncate(exchange.Request.Body, maxDebugBody)
+		exchange.Response.Body = truncate(exchange.Response.Body, maxDebugBody)
+		for i, call := range exchange.Calls {
+			exchange.Calls[i].Body = truncate(call.Body, maxDebugBody)
+		}
+		rec.recent = append(rec.recent, exchange)
+		if len(rec.recent) > rec.keep {
+			rec.recent = slices.Delete(rec.recent, 0, len(rec.recent)-rec.keep)
+		}
+	}
+}
+
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	return strings.ToValidUTF8(s[:limit], "") + "…"
+}
+
+// Record writes every request to `h` to the recording, with credentials redacted.
+func (rec *Recorder) Record(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requestBody := &limitedBuffer{limit: maxRecordedBody}
+		r.Body = readCloser{io.TeeReader(r.Body, requestBody), r.Body}
+		lrw := LoggingResponseWriter{ResponseWriter: rw, body: &limitedBuffer{limit: maxRecordedBody}}
+		start := time.Now()
+		h.ServeHTTP(&lrw, r)
+
+		requestID := requestIDFrom(r.Context())
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		calls := rec.calls[requestID]
+		delete(rec.calls, requestID)
+		rec.add(recordedExchange{
+			Time:      start,
+			Duration:  time.Since(start),
+			RequestID: requestID,
+			Request: recordedRequest{
+				Method:   r.Method,
+				Host:     r.Host,
+				Path:     r.URL.RequestURI(),
+				BasePath: basePathFrom(r.Context()),
+				Headers:  redactHeaders(r.Header),
+				Body:     requestBody.String(),
+			},
+			Response: recordedResponse{
+				Status:  lrw.Status(),
+				Headers: redactHeaders(lrw.Header()),
+				Body:    lrw.body.String(),
+			},
+			Calls: calls,
+		})
+	})
+}
+
+// Provider wraps `provider`, so that the calls its sessions make to ICA end up in the recording.
+func (rec *Recorder) Provider(provider ica.SessionProvider) ica.SessionProvider {
+	return recordingProvider{provider, rec, http.DefaultTransport}
+}
+
+type recordingProvider struct {
+	provider  ica.SessionProvider
+	recorder  *Recorder
+	transport http.RoundTripper
+}
+
+func (p recordingProvider) GetSession() (*ica.ICA, error) {
+	session, err := p.provider.GetSession()
+	if err != nil {
+		return nil, err
+	}
+	return session.WithTransport(recordingTransport{p.recorder, p.transport}), nil
+}
+
+type recordingTransport struct {
+	recorder *Recorder
+	next     http.RoundTripper
+}
+
+func (t recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	call := recordedCall{
+		Method:   req.Method,
+		URL:      req.URL.String(),
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		// Timeouts and connection resets are what's most interesting to replay
+		call.Error = err.Error()
+		t.record(req, call)
+		return nil, err
+	}
+	call.Status = resp.StatusCode
+	// Calls authenticated with the session cookie return tokens and personal details, so leave them out
+	if req.Header.Get("Cookie") == "" {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		call.Body = string(body)
+	}
+
+	t.record(req, call)
+	return resp, nil
+}
+
+func (t recordingTransport) record(req *http.Request, call recordedCall) {
+	requestID := req.Header.Get(requestIDHeader)
+	t.recorder.mu.Lock()
+	defer t.recorder.mu.Unlock()
+	t.recorder.calls[requestID] = append(t.recorder.calls[requestID], call)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const recordedLists = `[{"id":"list","name":"Handla","rows":[{"id":"row","text":"mjölk","isStriked":false,"updated":"2025-01-01T12:00:00Z"}]}]`
+
+func TestRecordAndReplay(t *testing.T) {
+	ica := &fakeICA{}
+	ica.expect([]recordedCall{{
+		Method: "GET",
+		URL:    "https://apimgw-pub.ica.se/sverige/digx/shopping-list/v1/api/list/all",
+		Status: http.StatusOK,
+		Body:   recordedLists,
+	}})
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	options := defaultBackendOptions
+	options.TitleCase = false
+	options.ProductID = "-//test//EN"
+	recorder, err := NewRecorder(path, 0, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := recordingProvider{replayProvider{ica}, recorder, ica}
+	handler := recorder.Record(newCalDAVHandler(provider, options, nil, nil, nil))
+
+	req := httptest.NewRequest("PROPFIND", "/user/shoppinglists/list/", strings.NewReader(""))
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Authorization", "Basic c2VjcmV0")
+	req = req.WithContext(context.WithValue(req.Context(), "requestID", "abc"))
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	recorder.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "c2VjcmV0") {
+		t.Error("Credentials recorded")
+	}
+	exchanges, err := readRecording(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exchanges) != 1 || exchanges[0].RequestID != "abc" || len(exchanges[0].Calls) != 2 {
+		t.Fatalf("Incorrect recording: %+v", exchanges)
+	}
+	if recorded := exchanges[0].Options; recorded == nil || recorded.TitleCase || recorded.ProductID != options.ProductID {
+		t.Errorf("Incorrect recorded options: %+v", recorded)
+	}
+	if exchanges[0].Response.Status != http.StatusMultiStatus || !strings.Contains(exchanges[0].Response.Body, "/user/shoppinglists/list/row") {
+		t.Errorf("Incorrect recorded response: %+v", exchanges[0].Response)
+	}
+
+	fake := &fakeICA{}
+	replayHandler := newCalDAVHandler(replayProvider{fake}, *exchanges[0].Options, nil, nil, nil)
+	if differences := replay(replayHandler, fake, exchanges[0]); len(differences) != 0 {
+		t.Errorf("Replay differed: %v", differences)
+	}
+
+	// Something else from ICA shows up in the diff
+	exchanges[0].Calls[1].Body = strings.Replace(recordedLists, "mjölk", "bröd", 1)
+	if differences := replay(replayHandler, fake, exchanges[0]); len(differences) == 0 {
+		t.Error("Changed response not detected")
+	}
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errors.New("connection reset by peer")
+}
+
+func TestRecordTransportError(t *testing.T) {
+	recorder, err := NewRecorder("", 1, defaultBackendOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := recordingProvider{replayProvider{&fakeICA{}}, recorder, failingTransport{}}
+	handler := recorder.Record(newCalDAVHandler(provider, defaultBackendOptions, nil, nil, nil))
+	req := httptest.NewRequest("PROPFIND", "/user/shoppinglists/list/", strings.NewReader(""))
+	req.Header.Set("Depth", "1")
+	req = req.WithContext(context.WithValue(req.Context(), "requestID", "abc"))
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	recent := recorder.Recent()
+	if len(recent) != 1 || len(recent[0].Calls) == 0 || recent[0].Calls[0].Error != "connection reset by peer" {
+		t.Fatalf("Failed call not recorded: %+v", recent)
+	}
+
+	// And fails the same way when replayed
+	fake := &fakeICA{}
+	replayHandler := newCalDAVHandler(replayProvider{fake}, defaultBackendOptions, nil, nil, nil)
+	if differences := replay(replayHandler, fake, recent[0]); len(differences) != 0 {
+		t.Errorf("Replay differed: %v", differences)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	differences := diffLines([]string{"a", "b", "c"}, []string{"a", "c", "d"})
+	expected := []string{"- b", "+ d"}
+	if strings.Join(differences, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Incorrect diff: %v", differences)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"ica-caldav/ica"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Headers that differ between runs even if nothing has changed
+var unstableHeaders = []string{"Date", requestIDHeader}
+
+// Replays a recording made with `--record` against a fake ICA, and shows where the responses differ.
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: replay <recording.jsonl>")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	exchanges, err := readRecording(file)
+	if err != nil {
+		return err
+	}
+
+	fake := &fakeICA{}
+	// With the options of the server, since e.g. title-casing changes every response
+	handlers := make(map[*BackendOptions]http.Handler)
+	failed := 0
+	for _, exchange := range exchanges {
+		handler, ok := handlers[exchange.Options]
+		if !ok {
+			options := defaultBackendOptions
+			if exchange.Options != nil {
+				options = *exchange.Options
+			}
+			handler = newCalDAVHandler(replayProvider{fake}, options, nil, nil, nil)
+			handlers[exchange.Options] = handler
+		}
+		differences := replay(handler, fake, exchange)
+		if len(differences) == 0 {
+			fmt.Printf("OK   %v %v\n", exchange.Request.Method, exchange.Request.Path)
+			continue
+		}
+		failed++
+		fmt.Printf("DIFF %v %v (%v)\n", exchange.Request.Method, exchange.Request.Path, exchange.RequestID)
+		for _, difference := range differences {
+			fmt.Printf("     %v\n", difference)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v of %v responses differed", failed, len(exchanges))
+	}
+	return nil
+}
+
+// readRecording returns the exchanges in a recording, with the options they were recorded with.
+// Those are nil for recordings made before options were written.
+func readRecording(r io.Reader) ([]recordedExchange, error) {
+	exchanges := make([]recordedExchange, 0)
+	var options *BackendOptions
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 4*maxRecordedBody)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var recorded recordingLine
+		err := json.Unmarshal(scanner.Bytes(), &recorded)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid recording on line %v: %w", line, err)
+		}
+		if recorded.Options != nil {
+			backendOptions, err := recorded.Options.backendOptions()
+			if err != nil {
+				return nil, fmt.Errorf("Invalid options on line %v: %w", line, err)
+			}
+			options = &backendOptions
+			continue
+		}
+		exchange := recorded.recordedExchange
+		exchange.Options = options
+		exchanges = append(exchanges, exchange)
+	}
+	return exchanges, scanner.Err()
+}
+
+// replay sends the recorded request to `handler`, and returns how the response differs from the recorded one.
+func replay(handler http.Handler, fake *fakeICA, exchange recordedExchange) []string {
+	fake.expect(exchange.Calls)
+	req := httptest.NewRequest(exchange.Request.Method, exchange.Request.Path, strings.NewReader(exchange.Request.Body))
+	req.Host = exchange.Request.Host
+	req.Header = exchange.Request.Headers.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	ctx := context.WithValue(req.Context(), "requestID", exchange.RequestID)
+	req = req.WithContext(context.WithValue(ctx, "basePath", exchange.Request.BasePath))
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	differences := make([]string, 0)
+	if rw.Code != exchange.Response.Status {
+		differences = append(differences, fmt.Sprintf("status: %v, recorded %v", rw.Code, exchange.Response.Status))
+	}
+	headers := redactHeaders(rw.Header())
+	for name := range mergeKeys(headers, exchange.Response.Headers) {
+		if slices.Contains(unstableHeaders, name) {
+			continue
+		}
+		if got, recorded := headers.Values(name), exchange.Response.Headers.Values(name); !slices.Equal(got, recorded) {
+			differences = append(differences, fmt.Sprintf("header %v: %q, recorded %q", name, got, recorded))
+		}
+	}
+	recorded, got := splitBody(exchange.Response.Body), splitBody(rw.Body.String())
+	// go-webdav returns properties in random order, so that doesn't count as a difference
+	if !slices.Equal(sortedLines(recorded), sortedLines(got)) {
+		differences = append(differences, "body:")
+		differences = append(differences, diffLines(recorded, got)...)
+	}
+	return differences
+}
+
+func mergeKeys(a http.Header, b http.Header) map[string]bool {
+	keys := make(map[string]bool)
+	for key := range a {
+		keys[http.CanonicalHeaderKey(key)] = true
+	}
+	for key := range b {
+		keys[http.CanonicalHeaderKey(key)] = true
+	}
+	return keys
+}
+
+func sortedLines(lines []string) []string {
+	sorted := slices.Clone(lines)
+	slices.Sort(sorted)
+	return sorted
+}
+
+// Puts every XML element and iCalendar property on a line of its own, so that the diff shows what changed.
+func splitBody(body string) []string {
+	body = strings.ReplaceAll(body, "><", ">\n<")
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	return strings.Split(body, "\n")
+}
+
+// diffLines returns the lines removed from `a` prefixed with `-`, and the ones added in `b` with `+`.
+func diffLines(a []string, b []string) []string {
+	// Longest common subsequence, from the end
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	lines := make([]string, 0)
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			lines = append(lines, "+ "+b[j])
+			j++
+		default:
+			lines = append(lines, "- "+a[i])
+			i++
+		}
+	}
+	return lines
+}
+
+type replayProvider struct {
+	fake *fakeICA
+}
+
+func (p replayProvider) GetSession() (*ica.ICA, error) {
+	session := ica.New("replay")
+	return session.WithTransport(p.fake), nil
+}
+
+// fakeICA answers calls to ICA with what was recorded for the request being replayed.
+type fakeICA struct {
+	mu    sync.Mutex
+	calls []recordedCall
+}
+
+func (f *fakeICA) expect(calls []recordedCall) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = slices.Clone(calls)
+}
+
+func (f *fakeICA) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status, body := http.StatusNotFound, "No recorded response"
+	if req.Header.Get("Cookie") != "" {
+		// Tokens aren't recorded, but any token will do
+		status, body = http.StatusOK, `{"accessToken":"replay"}`
+	}
+	for i, call := range f.calls {
+		if call.Method == req.Method && call.URL == req.URL.String() {
+			f.calls = slices.Delete(f.calls, i, i+1)
+			if call.Error != "" {
+				return nil, errors.New(call.Error)
+			}
+			status = call.Status
+			if call.Body != "" || status >= 400 {
+				body = call.Body
+			}
+			break
+		}
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %v", status, http.StatusText(status)),
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
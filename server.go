@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The first file descriptor passed by systemd socket activation, after stdin, stdout and stderr
+const listenFDsStart = 3
+
+// listen returns where to serve from: a socket inherited from systemd, or `address`, which is either
+// `unix:<path>` for a Unix domain socket with permissions `socketMode`, or a TCP address like `:5000`.
+func listen(address string, socketMode os.FileMode) (net.Listener, error) {
+	listener, err := inheritedListener()
+	if listener != nil || err != nil {
+		return listener, err
+	}
+
+	path, ok := strings.CutPrefix(address, "unix:")
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	// A socket left behind by an earlier run that didn't stop cleanly
+	if info, err := os.Stat(path); err == nil && info.Mode().Type() == os.ModeSocket {
+		os.Remove(path)
+	}
+	// Created with `socketMode` from the start, instead of changing it afterwards, so that there's
+	// no moment when anyone else can connect
+	restore := setUmask(0o777 &^ socketMode)
+	defer restore()
+	return net.Listen("unix", path)
+}
+
+// inheritedListener returns the socket systemd passed to us, following sd_listen_fds(3), or nil if
+// we weren't started by socket activation.
+func inheritedListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	// So that they aren't passed on to anything we start
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if count > 1 {
+		slog.Warn("Got more than one socket from systemd, only using the first",
+			"count", count,
+		)
+	}
+
+	file := os.NewFile(listenFDsStart, "LISTEN_FD_3")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid socket from systemd: %w", err)
+	}
+	return listener, nil
+}
+
+func parseSocketMode(mode string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 0o777 {
+		return 0, fmt.Errorf("%q isn't an octal file mode like 0660", mode)
+	}
+	return os.FileMode(value), nil
+}
+
+// serve runs `server` on `listener` until `ctx` is cancelled. It then stops accepting connections, and waits up to
+// `timeout` for requests in flight to finish, so that e.g. adds aren't lost when a container restarts.
+func serve(ctx context.Context, server *http.Server, listener net.Listener, tlsCert string, tlsKey string, timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		if tlsCert != "" {
+			errs <- server.ServeTLS(listener, tlsCert, tlsKey)
+		} else {
+			errs <- server.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down, waiting for requests in flight",
+		"timeout", timeout,
+	)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		server.Close()
+	}
+	return err
+}
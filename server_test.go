@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ica-caldav.sock")
+	listener, err := listen("unix:"+path, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Incorrect socket: %v %v", info, err)
+	}
+	listener.Close()
+
+	// A socket that wasn't removed, e.g. after a crash, is replaced
+	listener, err = listen("unix:"+path, 0o660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = listen("unix:"+path, 0o660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0o660 {
+		t.Errorf("Incorrect replaced socket: %v %v", info, err)
+	}
+	listener.Close()
+}
+
+func TestParseSocketMode(t *testing.T) {
+	if mode, err := parseSocketMode("0660"); err != nil || mode != 0o660 {
+		t.Errorf("Incorrect mode: %v %v", mode, err)
+	}
+	for _, invalid := range []string{"", "rw", "0999", "1777"} {
+		if _, err := parseSocketMode(invalid); err == nil {
+			t.Errorf("%q accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"ica-caldav/ica"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const passphraseEnv = "ICA_CALDAV_SESSION_PASSPHRASE"
+
+// How long we assume a pasted `thSessionId` is valid, since we have no way of knowing
+const defaultSessionIDValidity = 24 * time.Hour
+
+// Moves sessions between instances, e.g. from a laptop to a server, without doing BankID again.
+func runSession(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Usage: session export|import [flags]")
+	}
+	flags := flag.NewFlagSet(fmt.Sprintf("session %v", args[0]), flag.ExitOnError)
+	cacheOptions := addCacheFlags(flags)
+	passphrase := flags.String("passphrase", os.Getenv(passphraseEnv), fmt.Sprintf("Passphrase used to encrypt the exported session, defaults to $%v", passphraseEnv))
+
+	switch args[0] {
+	case "export":
+		err := parseCommandFlags(flags, args[1:])
+		if err != nil {
+			return err
+		}
+		cache, err := cacheOptions.open()
+		if err != nil {
+			return err
+		}
+		authenticator := ica.NewBankIDAuthentication(cache)
+		sealed, err := exportSession(authenticator, *passphrase)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(sealed))
+		return nil
+	case "import":
+		file := flags.String("file", "-", "File to read the exported session from, - for stdin")
+		sessionId := flags.String("thSessionId", "", "Import a thSessionId cookie copied from a browser, instead of an exported session")
+		validFor := flags.Duration("validFor", defaultSessionIDValidity, "How long an imported thSessionId is assumed to be valid")
+		err := parseCommandFlags(flags, args[1:])
+		if err != nil {
+			return err
+		}
+
+		cache, err := cacheOptions.open()
+		if err != nil {
+			return err
+		}
+		authenticator := ica.NewBankIDAuthentication(cache)
+		var validUntil *time.Time
+		if *sessionId != "" {
+			validUntil, err = authenticator.ImportSessionID(*sessionId, time.Now().Add(*validFor))
+		} else {
+			var sealed []byte
+			if *file == "-" {
+				sealed, err = io.ReadAll(os.Stdin)
+			} else {
+				sealed, err = os.ReadFile(*file)
+			}
+			if err != nil {
+				return err
+			}
+			validUntil, err = importSession(authenticator, *passphrase, sealed)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported session, valid until %v\n", validUntil.Format("2006-01-02 15:04:05"))
+		return nil
+	default:
+		return fmt.Errorf("Unknown session command: %v", args[0])
+	}
+}
+
+// Ends the session, e.g. when a device with access to it has been compromised.
+func runLogout(args []string) error {
+	flags := flag.NewFlagSet("logout", flag.ExitOnError)
+	cacheOptions := addCacheFlags(flags)
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	cache, err := cacheOptions.open()
+	if err != nil {
+		return err
+	}
+	err = ica.NewBankIDAuthentication(cache).Logout()
+	if err != nil {
+		return err
+	}
+	// The server keeps lists in memory only, but this is kept next to the session
+	history, err := LoadItemHistory(cache)
+	if err != nil {
+		return err
+	}
+	err = history.Clear()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Logged out")
+	return nil
+}
+
+func exportSession(authenticator *ica.BankIDAuthenticator, passphrase string) ([]byte, error) {
+	data, err := authenticator.ExportSession()
+	if err != nil {
+		return nil, err
+	}
+	return seal(passphrase, data)
+}
+
+func importSession(authenticator *ica.BankIDAuthenticator, passphrase string, sealed []byte) (*time.Time, error) {
+	data, err := unseal(passphrase, []byte(strings.TrimSpace(string(sealed))))
+	if err != nil {
+		return nil, err
+	}
+	return authenticator.ImportSession(data)
+}
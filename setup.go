@@ -1,87 +1,379 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
 	"embed"
+	"encoding/hex"
+	"errors"
+	"html/template"
 	"ica-caldav/ica"
-	"io"
 	"net/http"
-	"text/template"
+	"strings"
 	"time"
 )
 
-func newServerForSetup(authenticator *ica.BankIDAuthenticator) http.Handler {
+// Binds a login attempt to the browser that started it
+const loginAttemptCookie = "ica-caldav-login"
+
+// Holds the token that requests changing anything must include, so that other sites can't make them
+const csrfCookie = "ica-caldav-csrf"
+
+// htmx sends the token in this header, see `hx-headers` in index.html
+const csrfHeader = "X-CSRF-Token"
+
+// newServerForSetup serves the setup page. Sessions can only be moved through it with `sessionTransfer`,
+// which should only be enabled when nobody else can reach the page, since an exported session gives
+// full access to the ICA account.
+func newServerForSetup(authenticator *ica.BankIDAuthenticator, debugHandler http.Handler, sessionTransfer bool) http.Handler {
 	mux := http.NewServeMux()
 
+	mux.Handle("/debug", debugHandler)
+	mux.Handle("/debug/", debugHandler)
+
 	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
-		executeTemplate(rw, "index.html", getState(authenticator))
+		state := getStateFor(r, authenticator, currentAttempt(authenticator, r))
+		state.CSRFToken = csrfToken(rw, r)
+		if sessionTransfer {
+			state.Session = &SessionState{CSRFToken: state.CSRFToken}
+		}
+		executeTemplate(rw, "index.html", state)
 	})
 
-	mux.HandleFunc("/start", func(rw http.ResponseWriter, r *http.Request) {
-		err := authenticator.Start()
+	// Only reachable through the setup page itself
+	withCSRFCheck := func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(rw http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if !validCSRFToken(r) {
+				http.Error(rw, "Invalid CSRF token, reload the page", http.StatusForbidden)
+				return
+			}
+			handler(rw, r)
+		}
+	}
+
+	mux.HandleFunc("/start", withCSRFCheck(func(rw http.ResponseWriter, r *http.Request) {
+		// Only one attempt per browser
+		if attempt := currentAttempt(authenticator, r); attempt != nil {
+			attempt.Cancel()
+		}
+		method := ica.BankIDQRCode
+		if r.URL.Query().Get("method") == "samedevice" {
+			method = ica.BankIDSameDevice
+		}
+		attempt, err := authenticator.Start(method)
 		if err != nil {
 			state := SetupState{
-				Error: err,
+				Started: true,
+				Error:   err,
+				Hint:    &unknownErrorMessage,
 			}
 			executeTemplate(rw, "status", state)
 		} else {
-			executeTemplate(rw, "status", getState(authenticator))
+			http.SetCookie(rw, &http.Cookie{
+				Name:     loginAttemptCookie,
+				Value:    attempt.ID,
+				Path:     basePathFrom(r.Context()) + "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			executeTemplate(rw, "status", getStateFor(r, authenticator, attempt))
 		}
-	})
+	}))
+
+	mux.HandleFunc("/cancel", withCSRFCheck(func(rw http.ResponseWriter, r *http.Request) {
+		if attempt := currentAttempt(authenticator, r); attempt != nil {
+			attempt.Cancel()
+		}
+		http.SetCookie(rw, &http.Cookie{
+			Name:   loginAttemptCookie,
+			Path:   basePathFrom(r.Context()) + "/",
+			MaxAge: -1,
+		})
+		executeTemplate(rw, "status", getState(authenticator, nil))
+	}))
+
+	withSessionChecks := func(handler http.HandlerFunc) http.HandlerFunc {
+		checked := withCSRFCheck(handler)
+		return func(rw http.ResponseWriter, r *http.Request) {
+			if !sessionTransfer {
+				http.NotFound(rw, r)
+				return
+			}
+			checked(rw, r)
+		}
+	}
+
+	mux.HandleFunc("/session/export", withSessionChecks(func(rw http.ResponseWriter, r *http.Request) {
+		sealed, err := exportSession(authenticator, r.PostFormValue("passphrase"))
+		executeTemplate(rw, "session", SessionState{
+			Export:    string(sealed),
+			Error:     err,
+			CSRFToken: r.PostFormValue("csrf"),
+		})
+	}))
+
+	mux.HandleFunc("/session/import", withSessionChecks(func(rw http.ResponseWriter, r *http.Request) {
+		var err error
+		if sessionId := strings.TrimSpace(r.PostFormValue("thSessionId")); sessionId != "" {
+			_, err = authenticator.ImportSessionID(sessionId, time.Now().Add(defaultSessionIDValidity))
+		} else {
+			_, err = importSession(authenticator, r.PostFormValue("passphrase"), []byte(r.PostFormValue("session")))
+		}
+		if err != nil {
+			executeTemplate(rw, "session", SessionState{Error: err, CSRFToken: r.PostFormValue("csrf")})
+			return
+		}
+		// Reload everything, since the status has changed as well
+		rw.Header().Set("HX-Refresh", "true")
+	}))
+
+	mux.HandleFunc("/logout", withCSRFCheck(func(rw http.ResponseWriter, r *http.Request) {
+		err := authenticator.Logout()
+		if err != nil {
+			executeTemplate(rw, "status", SetupState{
+				Started: true,
+				Error:   err,
+				Hint:    &unknownErrorMessage,
+			})
+			return
+		}
+		http.SetCookie(rw, &http.Cookie{
+			Name:   loginAttemptCookie,
+			Path:   basePathFrom(r.Context()) + "/",
+			MaxAge: -1,
+		})
+		executeTemplate(rw, "status", getState(authenticator, nil))
+	}))
 
 	mux.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
-		executeTemplate(rw, "status", getState(authenticator))
+		executeTemplate(rw, "status", getStateFor(r, authenticator, currentAttempt(authenticator, r)))
 	})
 
 	return mux
 }
 
+// csrfToken returns the token of this browser, giving it one if it doesn't have one yet.
+func csrfToken(rw http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	token := make([]byte, 32)
+	rand.Read(token)
+	value := hex.EncodeToString(token)
+	http.SetCookie(rw, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    value,
+		Path:     basePathFrom(r.Context()) + "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return value
+}
+
+func validCSRFToken(r *http.Request) bool {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.PostFormValue("csrf")
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) == 1
+}
+
+func currentAttempt(authenticator *ica.BankIDAuthenticator, r *http.Request) *ica.LoginAttempt {
+	cookie, err := r.Cookie(loginAttemptCookie)
+	if err != nil {
+		return nil
+	}
+	return authenticator.Attempt(cookie.Value)
+}
+
 type SetupState struct {
 	Started    bool
+	State      ica.LoginState
 	ValidUntil *time.Time
 	Error      error
-	QRCode     string
+	Hint       *HintMessage
+	QRCode     template.URL
+	// Opens BankID on the same device
+	AutoStartLink template.URL
+	// Moving the session to or from another instance, nil if that's disabled
+	Session *SessionState
+	// Only set for the whole page, the fragments re-use the token it was rendered with
+	CSRFToken string
 }
 
-func getState(authenticator *ica.BankIDAuthenticator) SetupState {
-	sessionValidity := authenticator.SessionValidity()
-	if sessionValidity != nil {
-		return SetupState{
-			Started:    true,
-			ValidUntil: sessionValidity,
-		}
-	} else if !authenticator.HasStarted() {
-		return SetupState{
-			Started: false,
+type SessionState struct {
+	Export    string
+	Error     error
+	CSRFToken string
+}
+
+// HintMessage is what we tell the user about the current BankID status, based on the recommended
+// user messages (RFA) from BankID.
+type HintMessage struct {
+	Swedish string
+	English string
+	// Whether starting over is what the user should do next
+	Restart bool
+}
+
+var hintMessages = map[string]HintMessage{
+	ica.HintOutstandingTransaction: {
+		Swedish: "Starta BankID-appen och skanna QR-koden.",
+		English: "Start your BankID app and scan the QR code.",
+	},
+	ica.HintNoClient: {
+		Swedish: "Starta BankID-appen.",
+		English: "Start your BankID app.",
+	},
+	ica.HintStarted: {
+		Swedish: "Söker efter BankID, det kan ta en liten stund…",
+		English: "Searching for BankID, it may take a little while…",
+	},
+	ica.HintUserSign: {
+		Swedish: "Skriv in din säkerhetskod i BankID-appen och välj Identifiera.",
+		English: "Enter your security code in the BankID app and select Identify.",
+	},
+	ica.HintUserMrtd: {
+		Swedish: "Fortsätt i BankID-appen för att läsa av din ID-handling.",
+		English: "Continue in the BankID app to scan your ID document.",
+	},
+	ica.HintUserCallConfirm: {
+		Swedish: "Bekräfta samtalet i BankID-appen.",
+		English: "Confirm the call in the BankID app.",
+	},
+	ica.HintExpiredTransaction: {
+		Swedish: "BankID-appen svarar inte. Kontrollera att den är startad och att du har internetanslutning, försök sedan igen.",
+		English: "The BankID app is not responding. Make sure it's started and that you're connected to the internet, then try again.",
+		Restart: true,
+	},
+	ica.HintCertificateErr: {
+		Swedish: "Det BankID du försöker använda är för gammalt eller spärrat. Använd ett annat BankID eller skaffa ett nytt hos din bank.",
+		English: "The BankID you're trying to use is blocked or too old. Use another BankID or get a new one from your bank.",
+	},
+	ica.HintUserCancel: {
+		Swedish: "Inloggningen avbröts i BankID-appen.",
+		English: "The login was cancelled in the BankID app.",
+		Restart: true,
+	},
+	ica.HintCancelled: {
+		Swedish: "Inloggningen avbröts, eftersom en annan inloggning startades. Försök igen.",
+		English: "The login was cancelled, since another login was started. Try again.",
+		Restart: true,
+	},
+	ica.HintStartFailed: {
+		Swedish: "BankID-appen verkar inte finnas i din dator eller telefon. Installera den och hämta ett BankID hos din bank.",
+		English: "The BankID app couldn't be found on your computer or phone. Install it and get a BankID from your bank.",
+		Restart: true,
+	},
+	ica.HintUserDeclinedCall: {
+		Swedish: "Du avböjde samtalet i BankID-appen.",
+		English: "You declined the call in the BankID app.",
+		Restart: true,
+	},
+}
+
+var (
+	loginExpiredMessage = HintMessage{
+		Swedish: "Inloggningen tog för lång tid. Försök igen.",
+		English: "The login took too long. Try again.",
+		Restart: true,
+	}
+	loginCancelledMessage = HintMessage{
+		Swedish: "Inloggningen avbröts.",
+		English: "The login was cancelled.",
+		Restart: true,
+	}
+	unknownErrorMessage = HintMessage{
+		Swedish: "Okänt fel. Försök igen.",
+		English: "Unknown error. Try again.",
+		Restart: true,
+	}
+)
+
+func getHintMessage(status ica.LoginStatus) *HintMessage {
+	if status.Err != nil {
+		var bankIDError *ica.BankIDError
+		switch {
+		case errors.Is(status.Err, ica.ErrLoginExpired):
+			return &loginExpiredMessage
+		case errors.Is(status.Err, ica.ErrLoginCancelled):
+			return &loginCancelledMessage
+		case errors.As(status.Err, &bankIDError):
+			if message, ok := hintMessages[bankIDError.HintCode]; ok {
+				return &message
+			}
 		}
-	} else {
-		sessionValidity, qrCode, err := authenticator.Poll()
+		return &unknownErrorMessage
+	}
+	if message, ok := hintMessages[status.HintCode]; ok {
+		return &message
+	}
+	return nil
+}
+
+// Like getState, but also links back to the setup page when BankID is opened on the same device.
+func getStateFor(r *http.Request, authenticator *ica.BankIDAuthenticator, attempt *ica.LoginAttempt) SetupState {
+	state := getState(authenticator, attempt)
+	if attempt != nil && !state.State.Done() {
+		// A `bankid:` link, which html/template would filter out otherwise
+		state.AutoStartLink = template.URL(attempt.AutoStartLink(externalURL(r)))
+	}
+	return state
+}
+
+func getState(authenticator *ica.BankIDAuthenticator, attempt *ica.LoginAttempt) SetupState {
+	sessionValidity := authenticator.SessionValidity()
+	if attempt == nil || (sessionValidity != nil && attempt.Status().State == ica.LoginCompleted) {
 		if sessionValidity != nil {
 			return SetupState{
 				Started:    true,
+				State:      ica.LoginCompleted,
 				ValidUntil: sessionValidity,
 			}
-		} else if err != nil {
-			return SetupState{
-				Started: true,
-				Error:   err,
-			}
-		} else {
-			return SetupState{
-				Started: true,
-				QRCode:  qrCode,
-			}
 		}
+		return SetupState{
+			Started: false,
+		}
+	}
+
+	status := attempt.Poll()
+	return SetupState{
+		Started:    true,
+		State:      status.State,
+		ValidUntil: status.ValidUntil,
+		Error:      status.Err,
+		Hint:       getHintMessage(status),
+		QRCode:     qrCodeURL(status.QRCode),
+	}
+}
+
+// qrCodeURL lets the QR code from ICA through html/template, which filters out data URIs otherwise,
+// as long as it's an image.
+func qrCodeURL(dataURI string) template.URL {
+	if !strings.HasPrefix(dataURI, "data:image/") {
+		return ""
 	}
+	return template.URL(dataURI)
 }
 
 //go:embed templates
 var templates embed.FS
 
 // It's probably quicker to just fetch templates once, but this makes it support live-reload.
-func executeTemplate(rw io.Writer, name string, val any) {
+func executeTemplate(rw http.ResponseWriter, name string, val any) {
 	template, err := template.ParseFS(templates, "templates/*")
 	if err != nil {
 		panic(err)
 	}
+	// Fragments aren't sniffed as HTML, and this also tells withLogging not to log them
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
 	template.ExecuteTemplate(rw, name, val)
 }
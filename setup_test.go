@@ -0,0 +1,95 @@
+package main
+
+import (
+	"ica-caldav/ica"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSessionTransferChecks(t *testing.T) {
+	authenticator := ica.NewBankIDAuthentication(CacheFS{path: t.TempDir()})
+	post := func(handler http.Handler, path string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	disabled := newServerForSetup(authenticator, http.NotFoundHandler(), false)
+	if rw := post(disabled, "/session/export", url.Values{"passphrase": {"x"}}, nil); rw.Code != http.StatusNotFound {
+		t.Errorf("Export when disabled: %v", rw.Code)
+	}
+
+	handler := newServerForSetup(authenticator, http.NotFoundHandler(), true)
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	cookies := rw.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookie || !strings.Contains(rw.Body.String(), cookies[0].Value) {
+		t.Fatalf("No CSRF token: %v", cookies)
+	}
+	csrf := cookies[0]
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/session/export?passphrase=x", nil))
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Export with GET: %v", rw.Code)
+	}
+	if rw := post(handler, "/session/import", url.Values{"thSessionId": {"attacker"}}, nil); rw.Code != http.StatusForbidden {
+		t.Errorf("Import without CSRF token: %v", rw.Code)
+	}
+	if rw := post(handler, "/session/import", url.Values{"thSessionId": {"attacker"}, "csrf": {"guessed"}}, csrf); rw.Code != http.StatusForbidden {
+		t.Errorf("Import with wrong CSRF token: %v", rw.Code)
+	}
+	if authenticator.SessionValidity() != nil {
+		t.Fatal("Session was imported")
+	}
+	// Gets through to exporting, which fails since there's no session
+	rw = post(handler, "/session/export", url.Values{"passphrase": {"x"}, "csrf": {csrf.Value}}, csrf)
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `class="bad"`) {
+		t.Errorf("Export with CSRF token: %v %v", rw.Code, rw.Body.String())
+	}
+}
+
+func TestSetupActionsRequireCSRFToken(t *testing.T) {
+	authenticator := ica.NewBankIDAuthentication(CacheFS{path: t.TempDir()})
+	handler := newServerForSetup(authenticator, http.NotFoundHandler(), false)
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	cookies := rw.Result().Cookies()
+	if len(cookies) != 1 || !strings.Contains(rw.Body.String(), `"X-CSRF-Token": "`+cookies[0].Value+`"`) {
+		t.Fatalf("No CSRF token: %v", cookies)
+	}
+	csrf := cookies[0]
+
+	for _, path := range []string{"/start", "/cancel", "/logout"} {
+		rw = httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		if rw.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%v with GET: %v", path, rw.Code)
+		}
+		// Cookies are sent along with cross-site forms, but the token isn't
+		req := httptest.NewRequest("POST", path, nil)
+		req.AddCookie(csrf)
+		rw = httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		if rw.Code != http.StatusForbidden {
+			t.Errorf("%v without CSRF token: %v", path, rw.Code)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/cancel", nil)
+	req.AddCookie(csrf)
+	req.Header.Set(csrfHeader, csrf.Value)
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("Cancel with CSRF token: %v", rw.Code)
+	}
+}
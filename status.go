@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"ica-caldav/ica"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Monitor keeps track of how we're doing, for health checks and the status endpoint.
+type Monitor struct {
+	mu          sync.Mutex
+	lastSuccess *ica.Call
+	lastFailure *ica.Call
+	// When we last fetched the lists from ICA
+	lastListFetch time.Time
+
+	inFlight atomic.Int64
+}
+
+func (m *Monitor) ObserveCall(call ica.Call) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if call.Err != nil {
+		m.lastFailure = &call
+		return
+	}
+	m.lastSuccess = &call
+	if call.Endpoint == "list/all" {
+		m.lastListFetch = call.Start.Add(call.Duration)
+	}
+}
+
+// Track counts requests that are currently being handled.
+func (m *Monitor) Track(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.inFlight.Add(1)
+		defer m.inFlight.Add(-1)
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// Whether the last call to ICA went well, which it did if we haven't made any yet.
+func (m *Monitor) lastCallSucceeded() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lastFailure == nil {
+		return true
+	}
+	return m.lastSuccess != nil && m.lastSuccess.Start.After(m.lastFailure.Start)
+}
+
+type callStatus struct {
+	Endpoint   string    `json:"endpoint"`
+	Time       time.Time `json:"time"`
+	Status     int       `json:"status,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func newCallStatus(call *ica.Call) *callStatus {
+	if call == nil {
+		return nil
+	}
+	status := callStatus{
+		Endpoint:   call.Endpoint,
+		Time:       call.Start,
+		Status:     call.Status,
+		DurationMs: call.Duration.Milliseconds(),
+	}
+	if call.Err != nil {
+		status.Error = call.Err.Error()
+	}
+	return &status
+}
+
+type sessionStatus struct {
+	Valid            bool       `json:"valid"`
+	ValidUntil       *time.Time `json:"validUntil,omitempty"`
+	ExpiresInSeconds *int64     `json:"expiresInSeconds,omitempty"`
+}
+
+type serverStatus struct {
+	Session            sessionStatus `json:"session"`
+	Ready              bool          `json:"ready"`
+	LastSuccessfulCall *callStatus   `json:"lastSuccessfulCall"`
+	LastFailedCall     *callStatus   `json:"lastFailedCall"`
+	CacheAgeSeconds    *int64        `json:"cacheAgeSeconds"`
+	QueueDepth         int64         `json:"queueDepth"`
+}
+
+func (m *Monitor) status(validator sessionValidator, now time.Time) serverStatus {
+	var session sessionStatus
+	if validUntil := validator.SessionValidity(); validUntil != nil && validUntil.After(now) {
+		expiresIn := int64(validUntil.Sub(now).Seconds())
+		session = sessionStatus{
+			Valid:            true,
+			ValidUntil:       validUntil,
+			ExpiresInSeconds: &expiresIn,
+		}
+	}
+
+	status := serverStatus{
+		Session:    session,
+		Ready:      session.Valid && m.lastCallSucceeded(),
+		QueueDepth: m.inFlight.Load(),
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status.LastSuccessfulCall = newCallStatus(m.lastSuccess)
+	status.LastFailedCall = newCallStatus(m.lastFailure)
+	if !m.lastListFetch.IsZero() {
+		age := int64(now.Sub(m.lastListFetch).Seconds())
+		status.CacheAgeSeconds = &age
+	}
+	return status
+}
+
+func newServerForStatus(validator sessionValidator, monitor *Monitor, metrics *Metrics) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/metrics", metrics)
+
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/readyz", func(rw http.ResponseWriter, r *http.Request) {
+		status := monitor.status(validator, time.Now())
+		switch {
+		case !status.Session.Valid:
+			http.Error(rw, "no valid session", http.StatusServiceUnavailable)
+		case !status.Ready:
+			http.Error(rw, "last call to ICA failed", http.StatusServiceUnavailable)
+		default:
+			rw.Write([]byte("ok\n"))
+		}
+	})
+
+	mux.HandleFunc("/api/status", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(rw)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(monitor.status(validator, time.Now()))
+	})
+
+	return mux
+}
+
+func isStatusPath(path string) bool {
+	return path == "/healthz" || path == "/readyz" || path == "/api/status" || path == "/metrics"
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"ica-caldav/ica"
+	"testing"
+	"time"
+)
+
+type fixedValidity struct {
+	validUntil *time.Time
+}
+
+func (v fixedValidity) SessionValidity() *time.Time {
+	return v.validUntil
+}
+
+func TestMonitorStatus(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	validUntil := now.Add(time.Hour)
+	validator := fixedValidity{&validUntil}
+	monitor := &Monitor{}
+
+	status := monitor.status(validator, now)
+	if !status.Ready || *status.Session.ExpiresInSeconds != 3600 || status.CacheAgeSeconds != nil {
+		t.Errorf("Incorrect initial status: %+v", status)
+	}
+
+	monitor.ObserveCall(ica.Call{Endpoint: "list/all", Start: now.Add(-time.Minute), Duration: time.Second})
+	monitor.ObserveCall(ica.Call{Endpoint: "row", Start: now.Add(-30 * time.Second), Err: fmt.Errorf("Nope")})
+	status = monitor.status(validator, now)
+	if status.Ready {
+		t.Error("Ready after failed call")
+	}
+	if status.LastFailedCall == nil || status.LastFailedCall.Error != "Nope" {
+		t.Errorf("Incorrect last failed call: %+v", status.LastFailedCall)
+	}
+	if status.CacheAgeSeconds == nil || *status.CacheAgeSeconds != 59 {
+		t.Errorf("Incorrect cache age: %v", status.CacheAgeSeconds)
+	}
+
+	monitor.ObserveCall(ica.Call{Endpoint: "token", Start: now})
+	if status = monitor.status(validator, now); !status.Ready {
+		t.Error("Not ready after successful call")
+	}
+
+	if status = monitor.status(fixedValidity{}, now); status.Ready || status.Session.Valid {
+		t.Errorf("Ready without session: %+v", status)
+	}
+}
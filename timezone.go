@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+	// So that timezones work without zoneinfo installed, as in our Docker image
+	_ "time/tzdata"
+
+	"github.com/emersion/go-ical"
+)
+
+// ICA is only available in Sweden, so times without a timezone are most likely Swedish
+const defaultTimezone = "Europe/Stockholm"
+
+func mustLoadLocation(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return location
+}
+
+// dateTime reads property `name` from `component` of `calendar`, or returns zero if it isn't set.
+// Floating times are taken to be in `timezone`, as are times with a TZID we don't know, which
+// happens when clients name their VTIMEZONE e.g. "W. Europe Standard Time".
+func dateTime(calendar *ical.Calendar, component *ical.Component, name string, timezone *time.Location) (time.Time, error) {
+	prop := component.Props.Get(name)
+	if prop == nil {
+		return time.Time{}, nil
+	}
+	tzid := prop.Params.Get(ical.PropTimezoneID)
+	if tzid == "" {
+		return prop.DateTime(timezone)
+	}
+	if _, err := time.LoadLocation(tzid); err == nil {
+		return prop.DateTime(timezone)
+	}
+
+	location := timezone
+	if known := ianaTimezone(calendar, tzid); known != nil {
+		location = known
+	} else {
+		slog.Warn("Unknown timezone, using the default",
+			"tzid", tzid,
+			"timezone", timezone.String(),
+		)
+	}
+	floating := *prop
+	floating.Params = ical.Params{}
+	for key, values := range prop.Params {
+		if key != ical.PropTimezoneID {
+			floating.Params[key] = values
+		}
+	}
+	return floating.DateTime(location)
+}
+
+// ianaTimezone looks for the IANA name of `tzid` in its VTIMEZONE, which some clients add as X-LIC-LOCATION.
+func ianaTimezone(calendar *ical.Calendar, tzid string) *time.Location {
+	for _, child := range calendar.Children {
+		if child.Name != ical.CompTimezone {
+			continue
+		}
+		if id, _ := child.Props.Text(ical.PropTimezoneID); id != tzid {
+			continue
+		}
+		name, _ := child.Props.Text("X-LIC-LOCATION")
+		if location, err := time.LoadLocation(name); err == nil && name != "" {
+			return location
+		}
+	}
+	return nil
+}
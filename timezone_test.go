@@ -0,0 +1,56 @@
+package main
+
+import (
+	"ica-caldav/ica"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-ical"
+)
+
+const timezoneCalendar = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:test\r\n" +
+	"BEGIN:VTIMEZONE\r\nTZID:W. Europe Standard Time\r\nX-LIC-LOCATION:Europe/Berlin\r\nEND:VTIMEZONE\r\n" +
+	"BEGIN:VTODO\r\nUID:1\r\nDTSTAMP:20250101T120000Z\r\nSUMMARY:Mjölk\r\n" +
+	"COMPLETED:20250601T120000Z\r\n" +
+	"DUE:20250601T120000\r\n" +
+	"DTSTART;TZID=America/New_York:20250601T120000\r\n" +
+	"X-KNOWN;TZID=W. Europe Standard Time:20250601T120000\r\n" +
+	"X-UNKNOWN;TZID=Somewhere:20250601T120000\r\n" +
+	"END:VTODO\r\nEND:VCALENDAR\r\n"
+
+func TestDateTime(t *testing.T) {
+	calendar, err := ical.NewDecoder(strings.NewReader(timezoneCalendar)).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	todo, invalid := getTodo(calendar)
+	if invalid != nil {
+		t.Fatal(invalid.reason)
+	}
+	stockholm := mustLoadLocation(defaultTimezone)
+	for name, expected := range map[string]string{
+		ical.PropCompleted:     "2025-06-01T12:00:00Z",
+		ical.PropDue:           "2025-06-01T10:00:00Z",
+		ical.PropDateTimeStart: "2025-06-01T16:00:00Z",
+		"X-KNOWN":              "2025-06-01T10:00:00Z",
+		"X-UNKNOWN":            "2025-06-01T10:00:00Z",
+		"X-MISSING":            "0001-01-01T00:00:00Z",
+	} {
+		value, err := dateTime(calendar, todo, name, stockholm)
+		if err != nil || value.UTC().Format(time.RFC3339) != expected {
+			t.Errorf("Incorrect %v: %v %v", name, value, err)
+		}
+	}
+}
+
+func TestTodoTimesInUTC(t *testing.T) {
+	updated := time.Date(2025, 6, 1, 14, 0, 0, 0, time.FixedZone("", 2*60*60))
+	todo := createTodo(ica.ShoppingListRow{Id: "row", Name: "mjölk", IsStriked: true, Updated: updated}, time.Time{}, updated)
+	for _, name := range []string{ical.PropDateTimeStamp, ical.PropLastModified, ical.PropCompleted} {
+		prop := todo.Props.Get(name)
+		if prop.Value != "20250601T120000Z" || prop.Params.Get(ical.PropTimezoneID) != "" {
+			t.Errorf("Incorrect %v: %v", name, prop)
+		}
+	}
+}
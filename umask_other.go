@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// setUmask does nothing where there are no file permissions to restrict.
+func setUmask(mask os.FileMode) (restore func()) {
+	return func() {}
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// setUmask sets the permissions that new files don't get, until `restore` is called.
+func setUmask(mask os.FileMode) (restore func()) {
+	old := syscall.Umask(int(mask))
+	return func() {
+		syscall.Umask(old)
+	}
+}